@@ -1,62 +1,653 @@
 package toydns
 
 import (
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// what a cached reply says about its question
+const (
+	cachePositive = iota
+	cacheNXDomain // the name does not exist, whatever the type
+	cacheNoData   // the name exists, but has no records of the type
+	cacheServFail
+)
+
+const (
+	// TTL of stale answers, as recommended by RFC 8767
+	staleReplyTTL = 30
+	// seconds to serve stale data without waiting for upstreams
+	// after they failed to refresh it
+	staleRecheck = 30
+)
+
 type cacheItem struct {
-	ts   int64
-	ttl  int
-	pack []byte
+	key     string
+	name    string // the question name, which picks the shard
+	kind    int
+	ts      int64
+	ttl     int
+	pack    []byte
+	ttlOffs []int // where RR TTLs are in pack
+	failed  int64 // when upstreams last failed to refresh it
+	hits    int
+	// a refresh was started before it expires
+	prefetched bool
+	elem       *list.Element // position in lru list, nil if pinned
+	// set at runtime, never expires nor gets evicted
+	pinned bool
+	// for a client subnet, the prefix of it the entry applies to
+	ecs   bool
+	scope int
+}
+
+// a copy of pack with every TTL decreased by the time spent in cache,
+// or set to staleReplyTTL once expired
+func (self *cacheItem) packAt(nowts int64) []byte {
+	pack := make([]byte, len(self.pack))
+	copy(pack, self.pack)
+	if self.pinned {
+		return pack
+	}
+
+	elapsed := uint32(nowts - self.ts)
+	for _, off := range self.ttlOffs {
+		ttl := binary.BigEndian.Uint32(pack[off:])
+		if self.expired(nowts) {
+			ttl = staleReplyTTL
+		} else if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(pack[off:], ttl)
+	}
+	return pack
+}
+
+// the cached reply to a question, with its name cased as asked
+func (self *cacheItem) reply(nowts int64, q cacheQuestion) []byte {
+	pack := self.packAt(nowts)
+	setQuestion(pack, q.qname, q.qtype)
+	return pack
+}
+
+// rough memory used by an item, map and list overhead included
+func (self *cacheItem) size() int {
+	return len(self.key) + len(self.name) + len(self.pack) + len(self.ttlOffs)*8 + 128
+}
+
+func (self *cacheItem) expired(nowts int64) bool {
+	return !self.pinned && nowts-self.ts >= int64(self.ttl)
+}
+
+// expired and past the stale window too
+func (self *cacheItem) dead(nowts int64, staleWindow int) bool {
+	return !self.pinned && nowts-self.ts >= int64(self.ttl)+int64(staleWindow)
+}
+
+type cacheStats struct {
+	Entries      int
+	Bytes        int
+	Hits         uint64
+	NegativeHits uint64 // hits on NXDOMAIN, NODATA or SERVFAIL
+	StaleHits    uint64 // expired answers served as upstreams failed
+	Prefetches   uint64
+	Misses       uint64
+	Evictions    uint64 // removed to make room
+	Expirations  uint64 // removed after TTL
+}
+
+// number of shards, each with its own lock, a small cache gets fewer
+// so that every shard can still hold a useful number of entries
+const (
+	cacheShards     = 16
+	minShardEntries = 64
+	minShardBytes   = 64 << 10
+)
+
+// a part of the cache, entries are spread over shards by name
+type cacheShard struct {
+	lock       sync.Mutex
+	cache      map[string]*cacheItem
+	lru        *list.List // most recently used at front
+	maxEntries int        // 0 for no limit
+	maxBytes   int        // 0 for no limit
+	bytes      int
+	stats      cacheStats
+	// client subnet prefixes entries of a name are cached for, with
+	// the number of entries for each
+	scopes map[string]map[int]int
 }
 
 type dnsCache struct {
-	cache map[string]*cacheItem
+	shards []*cacheShard
+	// seconds expired items are kept for serving stale, 0 to drop them
+	staleWindow int
+	// refresh items hit this often once this much of their TTL passed
+	prefetchHits  int // 0 to never prefetch
+	prefetchRatio float64
 }
 
-var _lock sync.RWMutex
+func newDNSCache(maxEntries int, maxBytes int) *dnsCache {
+	nshards := cacheShards
+	for nshards > 1 &&
+		((maxEntries > 0 && maxEntries < nshards*minShardEntries) ||
+			(maxBytes > 0 && maxBytes < nshards*minShardBytes)) {
+		nshards /= 2
+	}
 
-func newDNSCache() *dnsCache {
 	dnscache := new(dnsCache)
-	dnscache.cache = make(map[string]*cacheItem, 0)
+	dnscache.shards = make([]*cacheShard, nshards)
+	for i := range dnscache.shards {
+		dnscache.shards[i] = &cacheShard{
+			cache:      make(map[string]*cacheItem, 0),
+			scopes:     make(map[string]map[int]int),
+			lru:        list.New(),
+			maxEntries: (maxEntries + nshards - 1) / nshards,
+			maxBytes:   (maxBytes + nshards - 1) / nshards,
+		}
+	}
 	return dnscache
 }
 
-func (self *dnsCache) Get(qname string, qtype int) ([]byte, bool) {
-	key := qname + ":" + strconv.Itoa(qtype)
-	_lock.RLock()
-	item, found := self.cache[key]
-	_lock.RUnlock()
+// what cached replies are told apart by, besides their kind
+type cacheQuestion struct {
+	qname  string // as asked
+	name   string // lower-cased
+	qtype  int
+	qclass int
+	do, cd bool
+	// client subnet of the query, nil without ECS, and the prefix of
+	// it the entry applies to
+	ecs   *dnsEDNS0Subnet
+	scope int
+}
+
+func newCacheQuestion(dnsq *dnsMsg) cacheQuestion {
+	q := dnsq.question[0]
+	cq := cacheQuestion{
+		qname:  q.Name,
+		name:   strings.ToLower(q.Name),
+		qtype:  int(q.Qtype),
+		qclass: int(q.Qclass),
+		cd:     dnsq.checking_disabled,
+	}
+	if opt := dnsq.opt(); opt != nil {
+		cq.do = opt.Do()
+		if cq.ecs = opt.Subnet(); cq.ecs != nil {
+			cq.scope = cq.ecs.SourcePrefix
+		}
+	}
+	return cq
+}
+
+func (self *cacheQuestion) key(kind int) string {
+	key := self.name + ":"
+	// NXDOMAIN covers all types of a name (RFC 2308 section 5)
+	if kind == cacheNXDomain {
+		key += "NXDOMAIN"
+	} else {
+		key += strconv.Itoa(self.qtype)
+	}
+	key += ":" + strconv.Itoa(self.qclass)
+	if self.do {
+		key += ":DO"
+	}
+	if self.cd {
+		key += ":CD"
+	}
+	if self.ecs != nil {
+		key += ":" + self.ecs.masked(self.scope)
+	}
+	// apart from the answer it failed to refresh, which is kept to
+	// serve stale
+	if kind == cacheServFail {
+		key += ":SERVFAIL"
+	}
+	return key
+}
+
+// all entries of a name live in the same shard
+func (self *dnsCache) shard(qname string) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(qname))
+	return self.shards[h.Sum32()%uint32(len(self.shards))]
+}
+
+// the entry answering a question, NXDOMAIN of the name included, for
+// client subnets from the most specific scope down
+// must be called with the shard lock held
+func (self *cacheShard) lookup(q cacheQuestion) (*cacheItem, bool) {
+	return self.lookupKinds(q, cachePositive, cacheNXDomain, cacheServFail)
+}
+
+// an answer that can be served stale, never a SERVFAIL
+func (self *cacheShard) lookupStale(q cacheQuestion) (*cacheItem, bool) {
+	return self.lookupKinds(q, cachePositive, cacheNXDomain)
+}
+
+// the client subnet prefixes to look q up under, the most specific
+// first, only those entries of the name are cached for
+func (self *cacheShard) lookupScopes(q cacheQuestion) []int {
+	if q.ecs == nil {
+		return []int{q.scope}
+	}
+	scopes := make([]int, 0, len(self.scopes[q.name]))
+	for scope := range self.scopes[q.name] {
+		if scope <= q.scope {
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(scopes)))
+	return scopes
+}
+
+// the first fresh item of the kinds, or else the first expired one
+func (self *cacheShard) lookupKinds(q cacheQuestion, kinds ...int) (*cacheItem, bool) {
+	// a pinned answer is for every client subnet, before any cached one
+	if q.ecs != nil {
+		pq := q
+		pq.ecs = nil
+		if item, found := self.cache[pq.key(cachePositive)]; found && item.pinned {
+			return item, true
+		}
+	}
+
+	var expired *cacheItem
+	nowts := time.Now().Unix()
+	for _, scope := range self.lookupScopes(q) {
+		q.scope = scope
+		for _, kind := range kinds {
+			if item, found := self.cache[q.key(kind)]; found {
+				if !item.expired(nowts) {
+					return item, true
+				}
+				if expired == nil {
+					expired = item
+				}
+			}
+		}
+	}
+	return expired, expired != nil
+}
+
+func (self *dnsCache) Get(q cacheQuestion) ([]byte, bool) {
+	shard := self.shard(q.name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	item, found := shard.lookup(q)
 	if !found {
+		shard.stats.Misses++
 		return nil, false
-	} else {
-		nowts := time.Now().Unix()
-		if nowts-item.ts >= int64(item.ttl) {
-			_lock.Lock()
-			delete(self.cache, key)
-			_lock.Unlock()
-			logger.Debug("Ttl expired")
-			return nil, false
+	}
+
+	nowts := time.Now().Unix()
+	if item.expired(nowts) {
+		// kept around in case upstreams fail
+		if item.dead(nowts, self.staleWindow) {
+			shard.remove(item)
+			shard.stats.Expirations++
 		}
-		return item.pack, true
+		shard.stats.Misses++
+		logger.Debug("Ttl expired")
+		return nil, false
 	}
+
+	shard.touch(item)
+	item.hits++
+	shard.stats.Hits++
+	if item.kind != cachePositive {
+		shard.stats.NegativeHits++
+	}
+	return item.reply(nowts, q), true
 }
 
-func (self *dnsCache) Insert(qname string, qtype int, pack []byte, ttl int) error {
-	key := qname + ":" + strconv.Itoa(qtype)
-	_lock.RLock()
-	_, found := self.cache[key]
-	_lock.RUnlock()
-	if found {
-		return nil
-	} else {
-		nowts := time.Now().Unix()
-		citem := &cacheItem{ts: nowts, ttl: ttl, pack: pack}
-		_lock.Lock()
-		self.cache[key] = citem
-		_lock.Unlock()
-		return nil
+// an expired answer still in the stale window (RFC 8767), never SERVFAIL
+func (self *dnsCache) GetStale(q cacheQuestion) ([]byte, bool) {
+	shard := self.shard(q.name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	nowts := time.Now().Unix()
+	item, found := shard.lookupStale(q)
+	if !found || item.dead(nowts, self.staleWindow) {
+		return nil, false
+	}
+	shard.touch(item)
+	shard.stats.StaleHits++
+	return item.reply(nowts, q), true
+}
+
+// whether a popular entry should be refreshed ahead of its expiry,
+// true only once for each entry
+func (self *dnsCache) ShouldPrefetch(q cacheQuestion) bool {
+	if self.prefetchHits <= 0 {
+		return false
+	}
+	shard := self.shard(q.name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	item, found := shard.lookup(q)
+	if !found || item.prefetched || item.kind == cacheServFail || item.hits < self.prefetchHits {
+		return false
+	}
+	elapsed := float64(time.Now().Unix() - item.ts)
+	if elapsed < float64(item.ttl)*self.prefetchRatio {
+		return false
+	}
+	item.prefetched = true
+	shard.stats.Prefetches++
+	return true
+}
+
+// upstreams could not refresh an expired entry
+func (self *dnsCache) MarkFailed(q cacheQuestion) {
+	shard := self.shard(q.name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if item, found := shard.lookupStale(q); found {
+		item.failed = time.Now().Unix()
+	}
+}
+
+// whether upstreams failed to refresh an expired entry lately, stale
+// data for it is served right away until staleRecheck passes
+func (self *dnsCache) Failing(q cacheQuestion) bool {
+	shard := self.shard(q.name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	nowts := time.Now().Unix()
+	item, found := shard.lookupStale(q)
+	return found && item.expired(nowts) && nowts-item.failed < staleRecheck
+}
+
+// rewrite the name and type of the question in a packed message, the
+// name is only replaced by one of the same length, as when the case differs
+func setQuestion(pack []byte, qname string, qtype int) {
+	if len(pack) < 12 || binary.BigEndian.Uint16(pack[4:]) != 1 {
+		return
+	}
+	_, off, err := unpackName(pack, 12)
+	if err != nil || off+2 > len(pack) {
+		return
+	}
+	if name := packName(qname, map[string]int{}, 12); len(name) == off-12 {
+		copy(pack[12:], name)
+	}
+	binary.BigEndian.PutUint16(pack[off:], uint16(qtype))
+}
+
+// cache a reply to q, which applies to q.scope of its client subnet
+func (self *dnsCache) Insert(q cacheQuestion, pack []byte, ttl int, kind int) error {
+	key := q.key(kind)
+	offs, _ := ttlOffsets(pack)
+	shard := self.shard(q.name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	nowts := time.Now().Unix()
+	shard.put(&cacheItem{
+		key: key, name: q.name, kind: kind, ts: nowts, ttl: ttl, pack: pack, ttlOffs: offs,
+		ecs: q.ecs != nil, scope: q.scope,
+	}, nowts)
+	return nil
+}
+
+// add an item at the front of the lru list, replacing an older entry
+// in the same critical section, must be called with the shard lock held
+func (self *cacheShard) put(citem *cacheItem, nowts int64) {
+	if item, found := self.cache[citem.key]; found {
+		if item.pinned {
+			return
+		}
+		// keep a fresh entry unless the new one outlives it, as
+		// after a prefetch
+		if !item.expired(nowts) && item.ts+int64(item.ttl) >= citem.ts+int64(citem.ttl) {
+			return
+		}
+		if item.expired(nowts) {
+			self.stats.Expirations++
+		}
+		self.remove(item)
+	}
+
+	self.cache[citem.key] = citem
+	if citem.ecs {
+		if self.scopes[citem.name] == nil {
+			self.scopes[citem.name] = make(map[int]int)
+		}
+		self.scopes[citem.name][citem.scope]++
+	}
+	if citem.pinned {
+		return
+	}
+	citem.elem = self.lru.PushFront(citem)
+	self.bytes += citem.size()
+
+	// evict least recently used items until we are in limits again
+	for self.overLimit() {
+		oldest := self.lru.Back().Value.(*cacheItem)
+		self.remove(oldest)
+		self.stats.Evictions++
+	}
+}
+
+func (self *cacheShard) overLimit() bool {
+	if self.lru.Len() == 0 {
+		return false
+	}
+	return (self.maxEntries > 0 && self.lru.Len() > self.maxEntries) ||
+		(self.maxBytes > 0 && self.bytes > self.maxBytes)
+}
+
+// must be called with the shard lock held
+func (self *cacheShard) remove(item *cacheItem) {
+	delete(self.cache, item.key)
+	if scopes := self.scopes[item.name]; item.ecs && scopes != nil {
+		if scopes[item.scope]--; scopes[item.scope] <= 0 {
+			delete(scopes, item.scope)
+		}
+		if len(scopes) == 0 {
+			delete(self.scopes, item.name)
+		}
 	}
+	if item.elem != nil {
+		self.lru.Remove(item.elem)
+		self.bytes -= item.size()
+	}
+}
+
+// mark an item most recently used
+func (self *cacheShard) touch(item *cacheItem) {
+	if item.elem != nil {
+		self.lru.MoveToFront(item.elem)
+	}
+}
+
+// remove all items expired beyond the stale window, returns how many were removed
+func (self *dnsCache) Sweep() int {
+	n := 0
+	nowts := time.Now().Unix()
+	for _, shard := range self.shards {
+		shard.lock.Lock()
+		swept := 0
+		for _, item := range shard.cache {
+			if item.dead(nowts, self.staleWindow) {
+				shard.remove(item)
+				swept++
+			}
+		}
+		shard.stats.Expirations += uint64(swept)
+		shard.lock.Unlock()
+		n += swept
+	}
+	return n
+}
+
+// counters of all shards summed up
+func (self *dnsCache) Stats() cacheStats {
+	var stats cacheStats
+	for _, shard := range self.shards {
+		shard.lock.Lock()
+		stats.Entries += len(shard.cache)
+		stats.Bytes += shard.bytes
+		stats.Hits += shard.stats.Hits
+		stats.NegativeHits += shard.stats.NegativeHits
+		stats.StaleHits += shard.stats.StaleHits
+		stats.Prefetches += shard.stats.Prefetches
+		stats.Misses += shard.stats.Misses
+		stats.Evictions += shard.stats.Evictions
+		stats.Expirations += shard.stats.Expirations
+		shard.lock.Unlock()
+	}
+	return stats
+}
+
+// what the control interface shows of an entry
+type cacheEntryInfo struct {
+	Key     string   `json:"key"`
+	Name    string   `json:"name"`
+	Kind    string   `json:"kind"`
+	TTL     int      `json:"ttl"` // remaining, negative once stale, 0 if pinned
+	Hits    int      `json:"hits"`
+	Pinned  bool     `json:"pinned"`
+	Records []string `json:"records"`
+}
+
+var cacheKindNames = map[int]string{
+	cachePositive: "positive",
+	cacheNXDomain: "NXDOMAIN",
+	cacheNoData:   "NODATA",
+	cacheServFail: "SERVFAIL",
+}
+
+// whether name is suffix or a name under it, suffix "" matches all
+func underSuffix(name string, suffix string) bool {
+	suffix = strings.ToLower(strings.TrimSuffix(suffix, "."))
+	name = strings.TrimSuffix(name, ".")
+	return suffix == "" || name == suffix || strings.HasSuffix(name, "."+suffix)
+}
+
+// entries for names under suffix, sorted by key
+func (self *dnsCache) List(suffix string) []cacheEntryInfo {
+	entries := []cacheEntryInfo{}
+	nowts := time.Now().Unix()
+	for _, shard := range self.shards {
+		shard.lock.Lock()
+		for _, item := range shard.cache {
+			if !underSuffix(item.name, suffix) {
+				continue
+			}
+			info := cacheEntryInfo{
+				Key:    item.key,
+				Name:   item.name,
+				Kind:   cacheKindNames[item.kind],
+				TTL:    int(item.ts + int64(item.ttl) - nowts),
+				Hits:   item.hits,
+				Pinned: item.pinned,
+			}
+			if item.pinned {
+				info.TTL = 0
+			}
+			msg := new(dnsMsg)
+			if _, err := msg.Unpack(item.packAt(nowts), 0); err == nil {
+				for _, sec := range [][]dnsRR{msg.answer, msg.ns} {
+					for _, rr := range sec {
+						info.Records = append(info.Records, rr.String())
+					}
+				}
+			}
+			entries = append(entries, info)
+		}
+		shard.lock.Unlock()
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// remove entries of exactly name, or of all names under it if suffix
+// is set, pinned ones included. Returns how many were removed.
+func (self *dnsCache) Flush(name string, suffix bool) int {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n := 0
+	for _, shard := range self.shards {
+		shard.lock.Lock()
+		for _, item := range shard.cache {
+			if item.name == name || (suffix && underSuffix(item.name, name)) {
+				shard.remove(item)
+				n++
+			}
+		}
+		shard.lock.Unlock()
+	}
+	return n
+}
+
+// remove every entry, returns how many were removed
+func (self *dnsCache) FlushAll() int {
+	return self.Flush("", true)
+}
+
+// answer questions for name and qtype with pack until flushed, whatever
+// DO and CD bits and client subnet they come with
+func (self *dnsCache) Pin(name string, qtype int, pack []byte) {
+	dnsq := new(dnsMsg)
+	dnsq.question = []dnsQuestion{{name, uint16(qtype), dnsClassINET}}
+	q := newCacheQuestion(dnsq)
+	offs, _ := ttlOffsets(pack)
+
+	shard := self.shard(q.name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	nowts := time.Now().Unix()
+	for _, do := range []bool{false, true} {
+		for _, cd := range []bool{false, true} {
+			q.do, q.cd = do, cd
+			if item, found := shard.cache[q.key(cachePositive)]; found {
+				shard.remove(item)
+			}
+			shard.put(&cacheItem{
+				key: q.key(cachePositive), name: q.name, kind: cachePositive,
+				ts: nowts, pack: pack, ttlOffs: offs, pinned: true,
+			}, nowts)
+		}
+	}
+}
+
+// sweep expired items every interval in background until done is
+// closed
+func (self *dnsCache) startSweeper(interval time.Duration, done <-chan bool) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			n := self.Sweep()
+			stats := self.Stats()
+			logger.Debug("Cache swept %d expired, %d entries %d bytes, "+
+				"hits %d (%d negative, %d stale) misses %d evictions %d expirations %d "+
+				"prefetches %d",
+				n, stats.Entries, stats.Bytes, stats.Hits, stats.NegativeHits, stats.StaleHits, stats.Misses,
+				stats.Evictions, stats.Expirations, stats.Prefetches)
+		}
+	}()
 }
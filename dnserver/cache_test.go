@@ -0,0 +1,644 @@
+package toydns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a plain IN question without EDNS0
+func testQuestion(qname string, qtype int) cacheQuestion {
+	q := new(dnsMsg)
+	q.question = []dnsQuestion{{qname, uint16(qtype), dnsClassINET}}
+	return newCacheQuestion(q)
+}
+
+// the entry of a question, to age it in tests
+func (self *dnsCache) item(qname string, qtype int) *cacheItem {
+	q := testQuestion(qname, qtype)
+	shard := self.shard(q.name)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	item, _ := shard.lookup(q)
+	return item
+}
+
+func Test_cache_lru(t *testing.T) {
+	cache := newDNSCache(3, 0)
+	for i := 0; i < 3; i++ {
+		cache.Insert(testQuestion(fmt.Sprintf("%d.example.com.", i), dnsTypeA), make([]byte, 100), 600, cachePositive)
+	}
+	// 0 becomes the most recently used, 1 goes first
+	cache.Get(testQuestion("0.example.com.", dnsTypeA))
+	cache.Insert(testQuestion("3.example.com.", dnsTypeA), make([]byte, 100), 600, cachePositive)
+
+	if _, found := cache.Get(testQuestion("1.example.com.", dnsTypeA)); found {
+		t.Error("least recently used entry not evicted")
+	}
+	for _, name := range []string{"0.example.com.", "2.example.com.", "3.example.com."} {
+		if _, found := cache.Get(testQuestion(name, dnsTypeA)); !found {
+			t.Errorf("%s evicted", name)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Entries != 3 || stats.Evictions != 1 || stats.Hits != 4 || stats.Misses != 1 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+}
+
+func Test_cache_limits(t *testing.T) {
+	item := &cacheItem{key: "0.example.com.:1:1", name: "0.example.com.", pack: make([]byte, 1000)}
+	cache := newDNSCache(0, item.size()*4)
+	for i := 0; i < 10; i++ {
+		cache.Insert(testQuestion(fmt.Sprintf("%d.example.com.", i), dnsTypeA), make([]byte, 1000), 600, cachePositive)
+	}
+	if stats := cache.Stats(); stats.Entries != 4 || stats.Bytes > item.size()*4 {
+		t.Errorf("memory limit not kept: %+v", stats)
+	}
+
+	cache.Insert(testQuestion("expired.example.com.", dnsTypeA), make([]byte, 10), 0, cachePositive)
+	if n := cache.Sweep(); n != 1 {
+		t.Errorf("swept %d entries, expected 1", n)
+	}
+	if stats := cache.Stats(); stats.Expirations != 1 {
+		t.Errorf("expiration not counted: %+v", stats)
+	}
+}
+
+func Test_cache_ttl(t *testing.T) {
+	msg := new(dnsMsg)
+	msg.id = 1234
+	msg.response = true
+	msg.question = []dnsQuestion{{"www.example.com.", dnsTypeA, dnsClassINET}}
+	a, _ := newRR("www.example.com.", dnsTypeA, 300, "10.0.0.1")
+	ns, _ := newRR("example.com.", dnsTypeNS, 3600, "ns.example.com.")
+	msg.answer = []dnsRR{a}
+	msg.ns = []dnsRR{ns}
+	msg.setOPT(newOPT(4096, true))
+	pack, _ := msg.Pack()
+
+	if ttl := msg.minTTL(); ttl != 300 {
+		t.Errorf("min TTL %d, expected 300", ttl)
+	}
+
+	cache := newDNSCache(0, 0)
+	cache.Insert(testQuestion("www.example.com.", dnsTypeA), pack, msg.minTTL(), cachePositive)
+	// pretend it has been cached for 100 seconds
+	cache.item("www.example.com.", dnsTypeA).ts -= 100
+
+	cpack, found := cache.Get(testQuestion("www.example.com.", dnsTypeA))
+	if !found {
+		t.Fatal("not cached")
+	}
+	reply := new(dnsMsg)
+	if _, err := reply.Unpack(cpack, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := reply.answer[0].Header().Ttl; ttl != 200 {
+		t.Errorf("answer TTL %d, expected 200", ttl)
+	}
+	if ttl := reply.ns[0].Header().Ttl; ttl != 3500 {
+		t.Errorf("authority TTL %d, expected 3500", ttl)
+	}
+	if opt := reply.opt(); opt == nil || !opt.Do() {
+		t.Error("OPT flags mangled")
+	}
+	if cpack[0] = 0; pack[0] == 0 {
+		t.Error("cache hit shares the cached packet")
+	}
+}
+
+func Test_cache_negative(t *testing.T) {
+	srv := &DNSServer{cfg: &srvConfig{NegativeCacheMaxTTL: 600, ServFailCacheTTL: 5}}
+	soa, _ := newRR("example.com.", dnsTypeSOA, 3600,
+		[]string{"ns.example.com.", "admin.example.com.", "1", "7200", "3600", "1209600", "900"})
+
+	msg := new(dnsMsg)
+	msg.id = 1234
+	msg.response = true
+	msg.rcode = dnsRcodeNameError
+	msg.question = []dnsQuestion{{"typo.example.com.", dnsTypeA, dnsClassINET}}
+	msg.ns = []dnsRR{soa}
+	pack, _ := msg.Pack()
+
+	kind, ttl, ok := srv.cacheTTL(msg, 0, 0)
+	if !ok || kind != cacheNXDomain || ttl != 600 {
+		t.Errorf("NXDOMAIN cached as %d for %d, %t", kind, ttl, ok)
+	}
+
+	// NXDOMAIN answers every type of the name
+	cache := newDNSCache(0, 0)
+	cache.Insert(testQuestion("typo.example.com.", dnsTypeA), pack, ttl, kind)
+	cpack, found := cache.Get(testQuestion("typo.example.com.", dnsTypeAAAA))
+	if !found {
+		t.Fatal("NXDOMAIN not cached")
+	}
+	reply := new(dnsMsg)
+	if _, err := reply.Unpack(cpack, 0); err != nil {
+		t.Fatal(err)
+	}
+	if reply.question[0].Qtype != dnsTypeAAAA || reply.rcode != dnsRcodeNameError {
+		t.Errorf("bad NXDOMAIN hit: %s", reply.String())
+	}
+
+	msg.rcode = dnsRcodeSuccess
+	if kind, ttl, ok := srv.cacheTTL(msg, 0, 0); !ok || kind != cacheNoData || ttl != 600 {
+		t.Errorf("NODATA cached as %d for %d, %t", kind, ttl, ok)
+	}
+	srv.cfg.NegativeCacheMaxTTL = 3600
+	if _, ttl, _ := srv.cacheTTL(msg, 0, 0); ttl != 900 {
+		t.Errorf("negative TTL %d, expected SOA minimum 900", ttl)
+	}
+
+	msg.ns = nil
+	if _, _, ok := srv.cacheTTL(msg, 0, 0); ok {
+		t.Error("negative answer without SOA cached")
+	}
+	msg.rcode = dnsRcodeServerFailure
+	if kind, ttl, ok := srv.cacheTTL(msg, 0, 0); !ok || kind != cacheServFail || ttl != 5 {
+		t.Errorf("SERVFAIL cached as %d for %d, %t", kind, ttl, ok)
+	}
+	msg.rcode = dnsRcodeRefused
+	if _, _, ok := srv.cacheTTL(msg, 0, 0); ok {
+		t.Error("REFUSED cached")
+	}
+}
+
+func Test_cache_stale(t *testing.T) {
+	msg := new(dnsMsg)
+	msg.id = 1234
+	msg.response = true
+	msg.question = []dnsQuestion{{"www.example.com.", dnsTypeA, dnsClassINET}}
+	a, _ := newRR("www.example.com.", dnsTypeA, 300, "10.0.0.1")
+	msg.answer = []dnsRR{a}
+	pack, _ := msg.Pack()
+
+	cache := newDNSCache(0, 0)
+	cache.staleWindow = 3600
+	cache.Insert(testQuestion("www.example.com.", dnsTypeA), pack, 300, cachePositive)
+	cache.item("www.example.com.", dnsTypeA).ts -= 600
+
+	if _, found := cache.Get(testQuestion("www.example.com.", dnsTypeA)); found {
+		t.Error("expired entry served as fresh")
+	}
+	if cache.Failing(testQuestion("www.example.com.", dnsTypeA)) {
+		t.Error("failing before upstreams failed")
+	}
+	cache.MarkFailed(testQuestion("www.example.com.", dnsTypeA))
+	if !cache.Failing(testQuestion("www.example.com.", dnsTypeA)) {
+		t.Error("upstream failure not remembered")
+	}
+	spack, found := cache.GetStale(testQuestion("www.example.com.", dnsTypeA))
+	if !found {
+		t.Fatal("stale entry dropped")
+	}
+	reply := new(dnsMsg)
+	reply.Unpack(spack, 0)
+	if ttl := reply.answer[0].Header().Ttl; ttl != staleReplyTTL {
+		t.Errorf("stale TTL %d, expected %d", ttl, staleReplyTTL)
+	}
+	if n := cache.Sweep(); n != 0 {
+		t.Error("stale entry swept")
+	}
+
+	cache.item("www.example.com.", dnsTypeA).ts -= 3600
+	if _, found := cache.GetStale(testQuestion("www.example.com.", dnsTypeA)); found {
+		t.Error("entry served beyond the stale window")
+	}
+	if n := cache.Sweep(); n != 1 {
+		t.Error("dead entry not swept")
+	}
+}
+
+func Test_cache_stale_servfail(t *testing.T) {
+	msg := new(dnsMsg)
+	msg.response = true
+	msg.question = []dnsQuestion{{"www.example.com.", dnsTypeA, dnsClassINET}}
+	a, _ := newRR("www.example.com.", dnsTypeA, 300, "10.0.0.1")
+	msg.answer = []dnsRR{a}
+	pack, _ := msg.Pack()
+	msg.answer = nil
+	msg.rcode = dnsRcodeServerFailure
+	fpack, _ := msg.Pack()
+
+	q := testQuestion("www.example.com.", dnsTypeA)
+	cache := newDNSCache(0, 0)
+	cache.staleWindow = 3600
+	cache.Insert(q, pack, 300, cachePositive)
+	cache.item("www.example.com.", dnsTypeA).ts -= 600
+
+	// the refresh failed with a SERVFAIL, cached for a while
+	cache.Insert(q, fpack, 5, cacheServFail)
+	cache.MarkFailed(q)
+	if cpack, found := cache.Get(q); !found || !servFailed(cpack) {
+		t.Error("cached SERVFAIL not served")
+	}
+	if !cache.Failing(q) {
+		t.Error("upstream failure not remembered")
+	}
+	spack, found := cache.GetStale(q)
+	if !found {
+		t.Fatal("stale answer lost after SERVFAIL was cached")
+	}
+	reply := new(dnsMsg)
+	reply.Unpack(spack, 0)
+	if reply.rcode != dnsRcodeSuccess || len(reply.answer) != 1 {
+		t.Errorf("stale answer %s", reply.String())
+	}
+
+	// a fresh answer wins over the SERVFAIL
+	cache.Insert(q, pack, 300, cachePositive)
+	if cpack, found := cache.Get(q); !found || servFailed(cpack) {
+		t.Error("SERVFAIL served over a fresh answer")
+	}
+}
+
+func Test_cache_prefetch(t *testing.T) {
+	cache := newDNSCache(0, 0)
+	cache.prefetchHits = 2
+	cache.prefetchRatio = 0.9
+	cache.Insert(testQuestion("www.example.com.", dnsTypeA), make([]byte, 100), 100, cachePositive)
+
+	cache.Get(testQuestion("www.example.com.", dnsTypeA))
+	cache.Get(testQuestion("www.example.com.", dnsTypeA))
+	if cache.ShouldPrefetch(testQuestion("www.example.com.", dnsTypeA)) {
+		t.Error("prefetching a fresh entry")
+	}
+
+	cache.item("www.example.com.", dnsTypeA).ts -= 95
+	cache.Get(testQuestion("www.example.com.", dnsTypeA))
+	if !cache.ShouldPrefetch(testQuestion("www.example.com.", dnsTypeA)) {
+		t.Error("popular entry near expiry not prefetched")
+	}
+	if cache.ShouldPrefetch(testQuestion("www.example.com.", dnsTypeA)) {
+		t.Error("entry prefetched twice")
+	}
+
+	// the refreshed answer replaces the old one, a shorter one does not
+	cache.Insert(testQuestion("www.example.com.", dnsTypeA), make([]byte, 100), 3, cachePositive)
+	if cache.item("www.example.com.", dnsTypeA).ttl != 100 {
+		t.Error("entry replaced by one expiring sooner")
+	}
+	cache.Insert(testQuestion("www.example.com.", dnsTypeA), make([]byte, 100), 100, cachePositive)
+	if item := cache.item("www.example.com.", dnsTypeA); item.ttl != 100 || item.prefetched || item.hits != 0 {
+		t.Error("prefetched entry not replaced")
+	}
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Prefetches != 1 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+}
+
+func Test_cache_shutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "toydns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache")
+
+	srv := newTestServer()
+	srv.cfg.CacheFile = path
+	srv.cache.startSweeper(10*time.Millisecond, srv.done)
+	srv.cache.startSaver(path, 10*time.Millisecond, srv.done)
+
+	// as on two signals at once
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.Shutdown()
+		}()
+	}
+	wg.Wait()
+	srv.Shutdown()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("cache not saved on shutdown")
+	}
+	os.Remove(path)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(path); err == nil {
+		t.Error("cache saved after shutdown")
+	}
+}
+
+func Test_cache_snapshot(t *testing.T) {
+	msg := new(dnsMsg)
+	msg.id = 1234
+	msg.response = true
+	msg.question = []dnsQuestion{{"www.example.com.", dnsTypeA, dnsClassINET}}
+	a, _ := newRR("www.example.com.", dnsTypeA, 300, "10.0.0.1")
+	msg.answer = []dnsRR{a}
+	pack, _ := msg.Pack()
+
+	cache := newDNSCache(0, 0)
+	cache.Insert(testQuestion("www.example.com.", dnsTypeA), pack, 300, cachePositive)
+	cache.Insert(testQuestion("typo.example.com.", dnsTypeA), pack, 300, cacheNXDomain)
+	cache.Insert(testQuestion("old.example.com.", dnsTypeA), pack, 300, cachePositive)
+	ecsq := new(dnsMsg)
+	ecsq.question = []dnsQuestion{{"cdn.example.com.", dnsTypeA, dnsClassINET}}
+	opt := newOPT(4096, false)
+	opt.Options = []dnsEDNS0Option{{Code: dnsOptionSubnet, Data: []byte{0, 1, 24, 0, 10, 1, 2}}}
+	ecsq.setOPT(opt)
+	cq := newCacheQuestion(ecsq)
+	cq.scope = 16
+	cache.Insert(cq, pack, 300, cachePositive)
+	cache.item("www.example.com.", dnsTypeA).ts -= 100
+	cache.item("old.example.com.", dnsTypeA).ts -= 400
+
+	dir, err := ioutil.TempDir("", "toydns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.snapshot")
+
+	if n, err := cache.Save(path); err != nil || n != 3 {
+		t.Fatalf("saved %d entries: %v", n, err)
+	}
+
+	loaded := newDNSCache(0, 0)
+	if n, err := loaded.Load(path); err != nil || n != 3 {
+		t.Fatalf("loaded %d entries: %v", n, err)
+	}
+	cpack, found := loaded.Get(testQuestion("www.example.com.", dnsTypeA))
+	if !found {
+		t.Fatal("entry lost")
+	}
+	reply := new(dnsMsg)
+	reply.Unpack(cpack, 0)
+	if ttl := reply.answer[0].Header().Ttl; ttl != 200 {
+		t.Errorf("TTL %d after reload, expected 200", ttl)
+	}
+	if _, found := loaded.Get(testQuestion("typo.example.com.", dnsTypeMX)); !found {
+		t.Error("NXDOMAIN entry lost")
+	}
+	if _, found := loaded.Get(testQuestion("old.example.com.", dnsTypeA)); found {
+		t.Error("expired entry loaded")
+	}
+	if _, found := loaded.Get(newCacheQuestion(ecsq)); !found {
+		t.Error("client subnet entry lost")
+	}
+}
+
+// a dnsConn that drops every reply
+type nullDNSConn struct{}
+
+func (c nullDNSConn) ReadPacketFrom() (*dnsMsg, net.Addr, error)   { return nil, nil, nil }
+func (c nullDNSConn) Read() ([]byte, error)                        { return nil, nil }
+func (c nullDNSConn) WritePacketTo(p *dnsMsg, addr net.Addr) error { return nil }
+func (c nullDNSConn) WriteTo(p []byte, addr net.Addr) error        { return nil }
+func (c nullDNSConn) Write(p []byte) error                         { return nil }
+func (c nullDNSConn) SetReadDeadline(t time.Time) error            { return nil }
+func (c nullDNSConn) Close() error                                 { return nil }
+func (c nullDNSConn) String() string                               { return "null" }
+
+// cache hits from many concurrent clients
+func Benchmark_cache_handleClient(b *testing.B) {
+	srv := &DNSServer{
+		cfg:      &srvConfig{EDNSBufferSize: dnsDefaultEDNSSize},
+		cache:    newDNSCache(10000, 32<<20),
+		inflight: newFlightGroup(),
+	}
+
+	queries := make([]*dnsMsg, 1000)
+	for i := range queries {
+		name := fmt.Sprintf("www%d.example.com.", i)
+		q := new(dnsMsg)
+		q.id = uint16(i)
+		q.recursion_desired = true
+		q.question = []dnsQuestion{{name, dnsTypeA, dnsClassINET}}
+		queries[i] = q
+
+		reply, _ := q.Reply()
+		rr, _ := newRR(name, dnsTypeA, 3600, "10.0.0.1")
+		reply.answer = []dnsRR{rr}
+		pack, _ := reply.Pack()
+		srv.cache.Insert(testQuestion(name, dnsTypeA), pack, 3600, cachePositive)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			srv.handleClient(nullDNSConn{}, queries[i%len(queries)], addr)
+			i++
+		}
+	})
+	b.StopTimer()
+
+	if stats := srv.cache.Stats(); stats.Misses > 0 {
+		b.Errorf("%d misses", stats.Misses)
+	}
+}
+
+func Test_cache_key(t *testing.T) {
+	query := func(name string, do bool, ecs []byte) *dnsMsg {
+		q := new(dnsMsg)
+		q.question = []dnsQuestion{{name, dnsTypeA, dnsClassINET}}
+		if do || ecs != nil {
+			opt := newOPT(4096, do)
+			if ecs != nil {
+				opt.Options = []dnsEDNS0Option{{Code: dnsOptionSubnet, Data: ecs}}
+			}
+			q.setOPT(opt)
+		}
+		return q
+	}
+	reply := func(q *dnsMsg) []byte {
+		r, _ := q.Reply()
+		rr, _ := newRR(q.question[0].Name, dnsTypeA, 300, "10.0.0.1")
+		r.answer = []dnsRR{rr}
+		pack, _ := r.Pack()
+		return pack
+	}
+
+	cache := newDNSCache(0, 0)
+	q := query("www.example.com.", false, nil)
+	cache.Insert(newCacheQuestion(q), reply(q), 300, cachePositive)
+
+	// names differing in case share the entry, the reply keeps the case asked
+	cpack, found := cache.Get(newCacheQuestion(query("WWW.Example.com.", false, nil)))
+	if !found {
+		t.Fatal("case sensitive cache key")
+	}
+	r := new(dnsMsg)
+	r.Unpack(cpack, 0)
+	if r.question[0].Name != "WWW.Example.com." {
+		t.Errorf("question %s not cased as asked", r.question[0].Name)
+	}
+
+	if _, found := cache.Get(newCacheQuestion(query("www.example.com.", true, nil))); found {
+		t.Error("DNSSEC OK query answered from a plain query")
+	}
+	q = query("www.example.com.", false, nil)
+	q.checking_disabled = true
+	if _, found := cache.Get(newCacheQuestion(q)); found {
+		t.Error("CD query answered from a plain query")
+	}
+	q = query("www.example.com.", false, nil)
+	q.question[0].Qclass = dnsClassCHAOS
+	if _, found := cache.Get(newCacheQuestion(q)); found {
+		t.Error("CHAOS query answered from IN")
+	}
+
+	// an answer for 10.1.0.0/16 serves the whole /16 only
+	q = query("cdn.example.com.", false, []byte{0, 1, 24, 0, 10, 1, 2})
+	cq := newCacheQuestion(q)
+	cq.scope = 16
+	cache.Insert(cq, reply(q), 300, cachePositive)
+	if _, found := cache.Get(newCacheQuestion(query("cdn.example.com.", false, []byte{0, 1, 24, 0, 10, 1, 99}))); !found {
+		t.Error("answer not shared within its scope")
+	}
+	if _, found := cache.Get(newCacheQuestion(query("cdn.example.com.", false, []byte{0, 1, 24, 0, 10, 2, 2}))); found {
+		t.Error("answer shared beyond its scope")
+	}
+	if _, found := cache.Get(newCacheQuestion(query("cdn.example.com.", false, nil))); found {
+		t.Error("subnet specific answer given to a query without ECS")
+	}
+
+	// only prefixes entries are cached for are looked up
+	shard := cache.shard("cdn.example.com.")
+	q = query("cdn.example.com.", false, []byte{0, 1, 24, 0, 10, 1, 2})
+	if scopes := shard.lookupScopes(newCacheQuestion(q)); len(scopes) != 1 || scopes[0] != 16 {
+		t.Errorf("looked up under prefixes %v", scopes)
+	}
+	cq = newCacheQuestion(q)
+	cache.Insert(cq, reply(q), 300, cachePositive)
+	if scopes := shard.lookupScopes(newCacheQuestion(q)); len(scopes) != 2 || scopes[0] != 24 {
+		t.Errorf("looked up under prefixes %v", scopes)
+	}
+	cache.Flush("cdn.example.com.", false)
+	if scopes, found := shard.scopes["cdn.example.com."]; found {
+		t.Errorf("prefixes %v kept after flush", scopes)
+	}
+}
+
+func Test_cache_admin(t *testing.T) {
+	cache := newDNSCache(0, 0)
+	for _, name := range []string{"www.example.com.", "mail.example.com.", "example.com.", "www.example.org."} {
+		cache.Insert(testQuestion(name, dnsTypeA), make([]byte, 100), 600, cachePositive)
+	}
+	if entries := cache.List("example.com"); len(entries) != 3 {
+		t.Errorf("listed %d entries under example.com", len(entries))
+	}
+	if n := cache.Flush("WWW.example.com", false); n != 1 {
+		t.Errorf("flushed %d entries of a name", n)
+	}
+	if n := cache.Flush("example.com.", true); n != 2 {
+		t.Errorf("flushed %d entries of a suffix", n)
+	}
+	if n := cache.FlushAll(); n != 1 {
+		t.Errorf("flushed %d entries of all", n)
+	}
+
+	rr, err := pinRR("pinned.example.com.", dnsTypeMX, 60, "10 mail.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same as in the records file
+	txt, err := pinRR("pinned.example.com.", dnsTypeTXT, 60, "v=spf1 mx -all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strs := txt.Rdata().([]string); len(strs) != 1 || strs[0] != "v=spf1 mx -all" {
+		t.Errorf("pinned TXT %q", strs)
+	}
+	msg := new(dnsMsg)
+	msg.response = true
+	msg.question = []dnsQuestion{{"pinned.example.com.", dnsTypeMX, dnsClassINET}}
+	msg.answer = []dnsRR{rr}
+	pack, _ := msg.Pack()
+	cache.Pin("pinned.example.com.", dnsTypeMX, pack)
+
+	q := new(dnsMsg)
+	q.question = []dnsQuestion{{"Pinned.example.com.", dnsTypeMX, dnsClassINET}}
+	q.checking_disabled = true
+	q.setOPT(newOPT(4096, true))
+	if _, found := cache.Get(newCacheQuestion(q)); !found {
+		t.Error("pinned answer not given to a DNSSEC query")
+	}
+	// pinned entries survive upstream answers and sweeps
+	cache.Insert(testQuestion("pinned.example.com.", dnsTypeMX), make([]byte, 100), 0, cachePositive)
+	cache.Sweep()
+	entries := cache.List("pinned.example.com.")
+	if len(entries) != 4 || !entries[0].Pinned || len(entries[0].Records) != 1 {
+		t.Errorf("bad pinned entries: %+v", entries)
+	}
+	if n := cache.Flush("pinned.example.com.", false); n != 4 {
+		t.Errorf("flushed %d pinned entries", n)
+	}
+
+	// over an answer for the client subnet asked
+	q = new(dnsMsg)
+	q.question = []dnsQuestion{{"pinned.example.com.", dnsTypeMX, dnsClassINET}}
+	opt := newOPT(4096, false)
+	opt.Options = []dnsEDNS0Option{{Code: dnsOptionSubnet, Data: []byte{0, 1, 24, 0, 10, 1, 2}}}
+	q.setOPT(opt)
+	cache.Insert(newCacheQuestion(q), make([]byte, 100), 600, cachePositive)
+	cache.Pin("pinned.example.com.", dnsTypeMX, pack)
+	cpack, found := cache.Get(newCacheQuestion(q))
+	if !found {
+		t.Fatal("pinned answer not given to an ECS query")
+	}
+	r := new(dnsMsg)
+	if _, err := r.Unpack(cpack, 0); err != nil || len(r.answer) != 1 {
+		t.Errorf("ECS query answered with %v, not the pinned answer", cpack)
+	}
+}
+
+func Test_cache_ttl_bounds(t *testing.T) {
+	srv := &DNSServer{cfg: &srvConfig{MinCacheTTL: 60, MaxCacheTTL: 86400}}
+	srv.ttlTree = newSuffixTree("", nil)
+	srv.ttlTree.sinsert([]string{"cdn", "example", "com"}, &ttlOverride{Suffix: "cdn.example.com", Min: 300})
+	srv.ttlTree.sinsert([]string{"example", "org"}, &ttlOverride{Suffix: "example.org", Max: 10})
+
+	for _, c := range []struct {
+		name     string
+		min, max int
+	}{
+		{"www.example.com.", 60, 86400},
+		{"img.CDN.example.com.", 300, 86400},
+		{"example.org.", 60, 10},
+	} {
+		if min, max := srv.ttlBounds(c.name); min != c.min || max != c.max {
+			t.Errorf("%s bounded to [%d, %d], expected [%d, %d]", c.name, min, max, c.min, c.max)
+		}
+	}
+
+	msg := new(dnsMsg)
+	msg.response = true
+	msg.question = []dnsQuestion{{"img.cdn.example.com.", dnsTypeA, dnsClassINET}}
+	a, _ := newRR("img.cdn.example.com.", dnsTypeA, 20, "10.0.0.1")
+	ns, _ := newRR("cdn.example.com.", dnsTypeNS, 604800, "ns.example.com.")
+	msg.answer = []dnsRR{a}
+	msg.ns = []dnsRR{ns}
+	msg.setOPT(newOPT(4096, true))
+	pack, _ := msg.Pack()
+
+	min, max := srv.ttlBounds("img.cdn.example.com.")
+	clampTTLs(pack, min, max)
+	reply := new(dnsMsg)
+	reply.Unpack(pack, 0)
+	if ttl := reply.answer[0].Header().Ttl; ttl != 300 {
+		t.Errorf("answer TTL %d, expected 300", ttl)
+	}
+	if ttl := reply.ns[0].Header().Ttl; ttl != 86400 {
+		t.Errorf("authority TTL %d, expected 86400", ttl)
+	}
+	if opt := reply.opt(); opt == nil || !opt.Do() {
+		t.Error("OPT flags mangled")
+	}
+	if _, ttl, _ := srv.cacheTTL(msg, min, max); ttl != 300 {
+		t.Errorf("cached for %d, expected 300", ttl)
+	}
+}
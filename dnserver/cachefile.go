@@ -0,0 +1,145 @@
+package toydns
+
+import (
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// bumped whenever cache keys or the snapshot layout change,
+// snapshots of other versions are ignored
+const cacheSnapshotVersion = 5
+
+type cacheSnapshotItem struct {
+	Key    string
+	Name   string
+	Kind   int
+	ECS    bool
+	Scope  int
+	TTL    int
+	Expire int64 // unix time the entry expires at
+	Pack   []byte
+}
+
+type cacheSnapshot struct {
+	Version int
+	Items   []cacheSnapshotItem // most recently used first in each shard
+}
+
+// write all unexpired entries to path, returns how many were saved
+func (self *dnsCache) Save(path string) (int, error) {
+	snapshot := cacheSnapshot{Version: cacheSnapshotVersion}
+	nowts := time.Now().Unix()
+
+	for _, shard := range self.shards {
+		shard.lock.Lock()
+		for e := shard.lru.Front(); e != nil; e = e.Next() {
+			item := e.Value.(*cacheItem)
+			if item.expired(nowts) {
+				continue
+			}
+			snapshot.Items = append(snapshot.Items, cacheSnapshotItem{
+				Key:    item.key,
+				Name:   item.name,
+				Kind:   item.kind,
+				ECS:    item.ecs,
+				Scope:  item.scope,
+				TTL:    item.ttl,
+				Expire: item.ts + int64(item.ttl),
+				Pack:   item.pack,
+			})
+		}
+		shard.lock.Unlock()
+	}
+
+	// write aside and rename, never leave a half written snapshot
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = gob.NewEncoder(tmp).Encode(&snapshot); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err = tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	return len(snapshot.Items), nil
+}
+
+// warm the cache from a snapshot, entries expired since are discarded,
+// returns how many were loaded
+func (self *dnsCache) Load(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var snapshot cacheSnapshot
+	if err = gob.NewDecoder(f).Decode(&snapshot); err != nil {
+		return 0, err
+	}
+	if snapshot.Version != cacheSnapshotVersion {
+		return 0, errors.New("Unsupported cache snapshot version")
+	}
+
+	n := 0
+	nowts := time.Now().Unix()
+	// least recently used first, so the order survives
+	for i := len(snapshot.Items) - 1; i >= 0; i-- {
+		sitem := snapshot.Items[i]
+		if sitem.Expire <= nowts {
+			continue
+		}
+		offs, err := ttlOffsets(sitem.Pack)
+		if err != nil {
+			continue
+		}
+		shard := self.shard(sitem.Name)
+		shard.lock.Lock()
+		shard.put(&cacheItem{
+			key:     sitem.Key,
+			name:    sitem.Name,
+			kind:    sitem.Kind,
+			ecs:     sitem.ECS,
+			scope:   sitem.Scope,
+			ts:      sitem.Expire - int64(sitem.TTL),
+			ttl:     sitem.TTL,
+			pack:    sitem.Pack,
+			ttlOffs: offs,
+		}, nowts)
+		shard.lock.Unlock()
+		n++
+	}
+	return n, nil
+}
+
+// save the cache to path every interval in background until done is
+// closed
+func (self *dnsCache) startSaver(path string, interval time.Duration, done <-chan bool) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			if n, err := self.Save(path); err != nil {
+				logger.Error("Failed to save cache: %s", err.Error())
+			} else {
+				logger.Debug("Saved %d cache entries to %s", n, path)
+			}
+		}
+	}()
+}
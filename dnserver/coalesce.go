@@ -0,0 +1,49 @@
+package toydns
+
+import (
+	"sync"
+)
+
+// an upstream query in flight, and the clients waiting for it
+type flightCall struct {
+	wg   sync.WaitGroup
+	pack []byte
+	err  error
+	dups int
+}
+
+// collapses concurrent identical questions into one upstream query
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// run fn for key unless it is already running, in which case wait
+// for it and share its result, shared tells whether others got it too
+func (self *flightGroup) Do(key string, fn func() ([]byte, error)) (pack []byte, err error, shared bool) {
+	self.lock.Lock()
+	if call, found := self.calls[key]; found {
+		call.dups++
+		self.lock.Unlock()
+		call.wg.Wait()
+		return call.pack, call.err, true
+	}
+	call := new(flightCall)
+	call.wg.Add(1)
+	self.calls[key] = call
+	self.lock.Unlock()
+
+	call.pack, call.err = fn()
+	call.wg.Done()
+
+	self.lock.Lock()
+	delete(self.calls, key)
+	shared = call.dups > 0
+	self.lock.Unlock()
+
+	return call.pack, call.err, shared
+}
@@ -0,0 +1,108 @@
+package toydns
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_flight_group(t *testing.T) {
+	group := newFlightGroup()
+	var calls int32
+	var wg sync.WaitGroup
+	release := make(chan bool)
+
+	nshared := int32(0)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pack, err, shared := group.Do("www.example.com.:1", func() ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return []byte{1, 2, 3}, nil
+			})
+			if err != nil || len(pack) != 3 {
+				t.Error("bad result", pack, err)
+			}
+			if shared {
+				atomic.AddInt32(&nshared, 1)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("%d calls for identical questions", calls)
+	}
+	if nshared != 10 {
+		t.Errorf("result shared with %d callers", nshared)
+	}
+
+	// nothing in flight any more, a new call runs again
+	group.Do("www.example.com.:1", func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+	if calls != 2 {
+		t.Error("finished call not forgotten")
+	}
+}
+
+// keeps what is written to clients
+type recordDNSConn struct {
+	nullDNSConn
+	lock    sync.Mutex
+	written [][]byte
+}
+
+func (c *recordDNSConn) WriteTo(p []byte, addr net.Addr) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.written = append(c.written, append([]byte(nil), p...))
+	return nil
+}
+
+func Test_flight_shared_question(t *testing.T) {
+	release := make(chan bool)
+	upstream, stop := startTestUpstream(t, func(q *dnsMsg) *dnsMsg {
+		<-release
+		return answerA("10.0.0.14")(q)
+	})
+	defer stop()
+	srv := newTestServer(upstream)
+	srv.cfg.UpstreamTimeout = 2000
+
+	conn := &recordDNSConn{}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	names := []string{"www.example.com.", "WwW.eXaMpLe.CoM.", "WWW.EXAMPLE.COM."}
+	var wg sync.WaitGroup
+	for i, name := range names {
+		q := testQuery(name)
+		q.id = uint16(200 + i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.handleClient(conn, q, addr)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if len(conn.written) != len(names) {
+		t.Fatalf("%d replies", len(conn.written))
+	}
+	for _, pack := range conn.written {
+		reply := new(dnsMsg)
+		reply.Unpack(pack, 0)
+		i := int(reply.id) - 200
+		if i < 0 || i >= len(names) || reply.question[0].Name != names[i] {
+			t.Errorf("reply %d for %s", reply.id, reply.question[0].Name)
+		}
+	}
+}
@@ -2,30 +2,133 @@ package toydns
 
 import (
 	"io/ioutil"
+	"strings"
 
 	"gopkg.in/yaml.v1"
 )
 
 const (
 	PROTO_UDP   = "UDP"
-	PROTO_DNS   = "DNS"
+	PROTO_TCP   = "TCP"
+	PROTO_DNS   = "DNS" // UDP and TCP
 	PROTO_CRYPT = "CRYPT"
 )
 
+const (
+	RRSET_FIXED       = "fixed"
+	RRSET_ROUND_ROBIN = "round_robin"
+	RRSET_RANDOM      = "random"
+)
+
+const maxServFailCacheTTL = 300
+
+const (
+	STRATEGY_SEQUENTIAL = "sequential"
+	STRATEGY_RACE       = "race"
+)
+
+// order upstreams of a group are asked in
+const (
+	SELECT_FIXED           = "fixed" // as configured
+	SELECT_FASTEST         = "fastest"
+	SELECT_WEIGHTED_RANDOM = "weighted_random"
+	SELECT_ROUND_ROBIN     = "round_robin"
+)
+
 type srvEntry struct {
 	Protocol string `yaml:"protocol"`
 	Addr     string `yaml:"addr"`
 	Port     int    `yaml:"port"`
 	Key      string `yaml:"key"`
+	// of an upstream, in milliseconds: the wait for a reply, 0 for
+	// upstream_timeout, doubled on each of retries asks after it, and
+	// the most a query may take whatever is left, 0 for no limit
+	Timeout  int `yaml:"timeout"`
+	Retries  int `yaml:"retries"`
+	Deadline int `yaml:"deadline"`
+}
+
+// TTL bounds for names under a suffix, 0 to use the global ones
+type ttlOverride struct {
+	Suffix string `yaml:"suffix"`
+	Min    int    `yaml:"min"`
+	Max    int    `yaml:"max"`
+}
+
+// upstreams the records file can send names to as @name
+type groupEntry struct {
+	Name      string     `yaml:"name"`
+	Selection string     `yaml:"selection"`
+	Upstreams []srvEntry `yaml:"upstreams"`
+}
+
+// a master zone file and the origin for relative names in it
+type zoneEntry struct {
+	Origin string `yaml:"origin"`
+	File   string `yaml:"file"`
 }
 
 type srvConfig struct {
 	Listen srvEntry `yaml:"listen"`
 
-	RecordFile string     `yaml:"record_file"`
-	Upstreams  []srvEntry `yaml:"upstreams"`
-	Repeat     int        `yaml:"repeat"`
-	FuckGFW    bool       `yaml:"fuck_gfw"`
+	RecordFile string      `yaml:"record_file"`
+	Zones      []zoneEntry `yaml:"zones"`
+	RRSetOrder string      `yaml:"rrset_order"`
+	Upstreams  []srvEntry  `yaml:"upstreams"`
+	Repeat     int         `yaml:"repeat"`
+	FuckGFW    bool        `yaml:"fuck_gfw"`
+	// selection of upstreams, by smoothed RTT and error rate for
+	// fastest and weighted_random
+	Selection      string       `yaml:"selection"`
+	UpstreamGroups []groupEntry `yaml:"upstream_groups"`
+
+	// ask upstreams one after another, or race_count of them at once
+	// taking the first good answer
+	Strategy  string `yaml:"strategy"`
+	RaceCount int    `yaml:"race_count"`
+	// milliseconds to wait for each upstream
+	UpstreamTimeout int `yaml:"upstream_timeout"`
+	// an upstream failing health_failures times in a row is skipped
+	// until it answers health_probe (an NS query), asked after
+	// health_backoff seconds and then less and less often
+	HealthFailures int    `yaml:"health_failures"`
+	HealthBackoff  int    `yaml:"health_backoff"`
+	HealthProbe    string `yaml:"health_probe"`
+
+	// UDP payload size advertised in EDNS0, and the largest
+	// UDP message we send or expect to receive
+	EDNSBufferSize int `yaml:"edns_buffer_size"`
+
+	// cache limits, 0 for unlimited, least recently used
+	// entries are evicted beyond them
+	CacheSize   int `yaml:"cache_size"`
+	CacheMemory int `yaml:"cache_memory"`
+	// seconds between sweeps of expired entries
+	CacheSweepInterval int `yaml:"cache_sweep_interval"`
+	// bounds of upstream TTLs, applied to what is cached and what
+	// clients get, 0 for no bound
+	MinCacheTTL  int           `yaml:"min_cache_ttl"`
+	MaxCacheTTL  int           `yaml:"max_cache_ttl"`
+	TTLOverrides []ttlOverride `yaml:"ttl_overrides"`
+	// upper bound of the TTL of cached NXDOMAIN and NODATA replies,
+	// which is otherwise taken from the SOA minimum
+	NegativeCacheMaxTTL int `yaml:"negative_cache_max_ttl"`
+	// seconds to cache SERVFAIL, 0 to never cache it
+	ServFailCacheTTL int `yaml:"servfail_cache_ttl"`
+	// seconds expired entries are kept to answer with when all
+	// upstreams fail (RFC 8767), 0 to disable
+	ServeStale int `yaml:"serve_stale"`
+	// refresh entries hit at least prefetch_hits times once
+	// prefetch_ratio of their TTL has passed, 0 hits to disable
+	PrefetchHits  int     `yaml:"prefetch_hits"`
+	PrefetchRatio float64 `yaml:"prefetch_ratio"`
+	// snapshot of the cache, loaded at startup and saved every
+	// cache_save_interval seconds and on shutdown, "" to disable
+	CacheFile         string `yaml:"cache_file"`
+	CacheSaveInterval int    `yaml:"cache_save_interval"`
+
+	// unix socket of the control interface, "" to disable
+	ControlSocket string `yaml:"control_socket"`
 }
 
 func loadConfig(cfgFile string) (*srvConfig, error) {
@@ -36,8 +139,35 @@ func loadConfig(cfgFile string) (*srvConfig, error) {
 			Port:     53,
 		},
 		RecordFile: "",
-		Repeat:     1,
-		FuckGFW:    false,
+		RRSetOrder: RRSET_ROUND_ROBIN,
+		Selection:  SELECT_FIXED,
+		Strategy:   STRATEGY_SEQUENTIAL,
+		RaceCount:  2,
+
+		UpstreamTimeout: 2000,
+		HealthFailures:  3,
+		HealthBackoff:   30,
+		HealthProbe:     ".",
+		Repeat:          1,
+		FuckGFW:         false,
+
+		EDNSBufferSize: dnsDefaultEDNSSize,
+
+		CacheSize:          10000,
+		CacheMemory:        32 << 20,
+		CacheSweepInterval: 60,
+
+		MinCacheTTL: 0,
+		MaxCacheTTL: 0,
+
+		NegativeCacheMaxTTL: 3600,
+		ServFailCacheTTL:    5,
+
+		PrefetchHits:  0,
+		PrefetchRatio: 0.9,
+
+		CacheFile:         "",
+		CacheSaveInterval: 300,
 	}
 
 	if cfgFile != "" {
@@ -54,6 +184,38 @@ func loadConfig(cfgFile string) (*srvConfig, error) {
 		}
 
 	}
+
+	if cfg.EDNSBufferSize < dnsMinUDPSize {
+		cfg.EDNSBufferSize = dnsMinUDPSize
+	}
+	if cfg.Strategy != STRATEGY_RACE {
+		cfg.Strategy = STRATEGY_SEQUENTIAL
+	}
+	if cfg.RaceCount < 1 {
+		cfg.RaceCount = 1
+	}
+	if cfg.UpstreamTimeout <= 0 {
+		cfg.UpstreamTimeout = 2000
+	}
+	if cfg.HealthBackoff <= 0 {
+		cfg.HealthBackoff = 30
+	}
+	if !strings.HasSuffix(cfg.HealthProbe, ".") {
+		cfg.HealthProbe += "."
+	}
+	if cfg.CacheSweepInterval <= 0 {
+		cfg.CacheSweepInterval = 60
+	}
+	if cfg.CacheSaveInterval <= 0 {
+		cfg.CacheSaveInterval = 300
+	}
+	if cfg.PrefetchRatio <= 0 || cfg.PrefetchRatio >= 1 {
+		cfg.PrefetchRatio = 0.9
+	}
+	// RFC 2308 section 7.1, never hold on to a failure for long
+	if cfg.ServFailCacheTTL > maxServFailCacheTTL {
+		cfg.ServFailCacheTTL = maxServFailCacheTTL
+	}
 	logger.Debug("%v", cfg)
 	return &cfg, nil
 
@@ -1,9 +1,12 @@
 package toydns
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -14,15 +17,17 @@ type dnsConn interface {
 	WriteTo(p []byte, addr net.Addr) error
 	Write(p []byte) error
 	SetReadDeadline(t time.Time) error
+	Close() error
 	String() string
 }
 
 type udpDNSConn struct {
 	addr    string
 	udpConn *net.UDPConn
+	bufSize int
 }
 
-func listenUDPDNS(addr string) (*udpDNSConn, error) {
+func listenUDPDNS(addr string, bufSize int) (*udpDNSConn, error) {
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		logger.Error(err.Error())
@@ -35,11 +40,11 @@ func listenUDPDNS(addr string) (*udpDNSConn, error) {
 		return nil, err
 	}
 
-	return &udpDNSConn{addr, udpConn}, nil
+	return &udpDNSConn{addr, udpConn, bufSize}, nil
 
 }
 
-func dialUDPDNS(addr string) (*udpDNSConn, error) {
+func dialUDPDNS(addr string, bufSize int) (*udpDNSConn, error) {
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		logger.Error(err.Error())
@@ -51,17 +56,17 @@ func dialUDPDNS(addr string) (*udpDNSConn, error) {
 		return nil, err
 	}
 
-	return &udpDNSConn{addr, udpConn}, nil
+	return &udpDNSConn{addr, udpConn, bufSize}, nil
 }
 
 func (u *udpDNSConn) Read() ([]byte, error) {
-	buf := make([]byte, 512)
+	buf := make([]byte, u.bufSize)
 	n, err := u.udpConn.Read(buf)
 	return buf[:n], err
 }
 
 func (u *udpDNSConn) ReadPacketFrom() (*dnsMsg, net.Addr, error) {
-	buf := make([]byte, 512)
+	buf := make([]byte, u.bufSize)
 	n, clientAddr, err := u.udpConn.ReadFromUDP(buf[0:])
 	if err != nil {
 		logger.Error(err.Error())
@@ -113,6 +118,10 @@ func (u *udpDNSConn) SetReadDeadline(t time.Time) error {
 	return u.udpConn.SetReadDeadline(t)
 }
 
+func (u *udpDNSConn) Close() error {
+	return u.udpConn.Close()
+}
+
 func (u *udpDNSConn) String() string {
 	return "dns:" + u.addr
 }
@@ -121,9 +130,13 @@ type cryptDNSConn struct {
 	addr    string
 	udpConn *net.UDPConn
 	cipher  *dnsCipher
+	bufSize int
 }
 
-func listenCryptDNS(addr string, cipher *dnsCipher) (*cryptDNSConn, error) {
+// iv, one block of padding at most and crc32
+const cryptOverhead = cipherBlockSize*2 + 4
+
+func listenCryptDNS(addr string, cipher *dnsCipher, bufSize int) (*cryptDNSConn, error) {
 	if cipher == nil {
 		return nil, errors.New("Cipher not inited")
 	}
@@ -139,11 +152,11 @@ func listenCryptDNS(addr string, cipher *dnsCipher) (*cryptDNSConn, error) {
 		return nil, err
 	}
 
-	return &cryptDNSConn{addr, udpConn, cipher}, nil
+	return &cryptDNSConn{addr, udpConn, cipher, bufSize + cryptOverhead}, nil
 
 }
 
-func dialCryptDNS(addr string, cipher *dnsCipher) (*cryptDNSConn, error) {
+func dialCryptDNS(addr string, cipher *dnsCipher, bufSize int) (*cryptDNSConn, error) {
 	if cipher == nil {
 		return nil, errors.New("Cipher not inited")
 	}
@@ -158,11 +171,11 @@ func dialCryptDNS(addr string, cipher *dnsCipher) (*cryptDNSConn, error) {
 		return nil, err
 	}
 
-	return &cryptDNSConn{addr, udpConn, cipher}, nil
+	return &cryptDNSConn{addr, udpConn, cipher, bufSize + cryptOverhead}, nil
 }
 
 func (u *cryptDNSConn) ReadPacketFrom() (*dnsMsg, net.Addr, error) {
-	buf := make([]byte, 1024)
+	buf := make([]byte, u.bufSize)
 	n, clientAddr, err := u.udpConn.ReadFromUDP(buf[0:])
 	if err != nil {
 		logger.Error(err.Error())
@@ -187,7 +200,7 @@ func (u *cryptDNSConn) ReadPacketFrom() (*dnsMsg, net.Addr, error) {
 }
 
 func (u *cryptDNSConn) Read() ([]byte, error) {
-	buf := make([]byte, 1024)
+	buf := make([]byte, u.bufSize)
 	n, err := u.udpConn.Read(buf)
 	if err != nil {
 		return []byte{}, err
@@ -233,18 +246,160 @@ func (u *cryptDNSConn) SetReadDeadline(t time.Time) error {
 	return u.udpConn.SetReadDeadline(t)
 }
 
+func (u *cryptDNSConn) Close() error {
+	return u.udpConn.Close()
+}
+
 func (u *cryptDNSConn) String() string {
 	return "crypt:" + u.addr
 }
 
-func listenDNS(e srvEntry) (dnsConn, error) {
+// DNS over TCP, every message is prefixed with a two-byte length (RFC 1035 4.2.2)
+type tcpDNSConn struct {
+	addr    string
+	tcpConn *net.TCPConn
+	wlock   sync.Mutex
+}
+
+type tcpDNSListener struct {
+	addr     string
+	listener *net.TCPListener
+}
+
+func listenTCPDNS(addr string) (*tcpDNSListener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	return &tcpDNSListener{addr: addr, listener: listener}, nil
+}
+
+func (l *tcpDNSListener) Accept() (*tcpDNSConn, error) {
+	tcpConn, err := l.listener.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	return &tcpDNSConn{addr: tcpConn.RemoteAddr().String(), tcpConn: tcpConn}, nil
+}
+
+func (l *tcpDNSListener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *tcpDNSListener) String() string {
+	return "tcp:" + l.addr
+}
+
+func dialTCPDNS(addr string) (*tcpDNSConn, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+	tcpConn, err := net.DialTCP("tcp", nil, tcpAddr)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	return &tcpDNSConn{addr: addr, tcpConn: tcpConn}, nil
+}
+
+func (u *tcpDNSConn) Read() ([]byte, error) {
+	var length uint16
+	if err := binary.Read(u.tcpConn, binary.BigEndian, &length); err != nil {
+		return []byte{}, err
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(u.tcpConn, buf); err != nil {
+		return []byte{}, err
+	}
+	return buf, nil
+}
+
+func (u *tcpDNSConn) ReadPacketFrom() (*dnsMsg, net.Addr, error) {
+	clientAddr := u.tcpConn.RemoteAddr()
+	buf, err := u.Read()
+	if err != nil {
+		return nil, clientAddr, err
+	}
+
+	msg := new(dnsMsg)
+	_, err = msg.Unpack(buf, 0)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, clientAddr, err
+	}
+
+	return msg, clientAddr, nil
+}
+
+func (u *tcpDNSConn) WritePacketTo(p *dnsMsg, addr net.Addr) error {
+	pack, err := p.Pack()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	return u.Write(pack)
+}
+
+// the connection is already bound to a peer, addr is ignored
+func (u *tcpDNSConn) WriteTo(p []byte, addr net.Addr) error {
+	return u.Write(p)
+}
+
+func (u *tcpDNSConn) Write(p []byte) error {
+	if len(p) > 0xFFFF {
+		return errors.New("Message too long")
+	}
+
+	buf := make([]byte, len(p)+2)
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	copy(buf[2:], p)
+
+	u.wlock.Lock()
+	_, err := u.tcpConn.Write(buf)
+	u.wlock.Unlock()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (u *tcpDNSConn) SetReadDeadline(t time.Time) error {
+	return u.tcpConn.SetReadDeadline(t)
+}
+
+func (u *tcpDNSConn) Close() error {
+	return u.tcpConn.Close()
+}
+
+func (u *tcpDNSConn) String() string {
+	return "tcp:" + u.addr
+}
+
+func listenDNS(e srvEntry, bufSize int) (dnsConn, error) {
 	addr := fmt.Sprintf("%s:%d", e.Addr, e.Port)
 	switch e.Protocol {
 	case PROTO_UDP, PROTO_DNS:
-		return listenUDPDNS(addr)
+		return listenUDPDNS(addr, bufSize)
 	case PROTO_CRYPT:
 		cipher, _ := newCipher([]byte(e.Key))
-		return listenCryptDNS(addr, cipher)
+		return listenCryptDNS(addr, cipher, bufSize)
+	case PROTO_TCP:
+		return nil, errors.New("TCP is not a packet protocol, use listenTCPDNS")
 	default:
 		return nil, errors.New("Undifined Protocol")
 	}
@@ -0,0 +1,142 @@
+package toydns
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testTCPQuery(id uint16, name string) *dnsMsg {
+	q := new(dnsMsg)
+	q.id = id
+	q.recursion_desired = true
+	q.question = []dnsQuestion{{Name: name, Qtype: uint16(dnsTypeA), Qclass: uint16(dnsClassINET)}}
+	return q
+}
+
+func Test_tcp_framing(t *testing.T) {
+	ln, err := listenTCPDNS("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.listener.Addr().String()
+
+	type read struct {
+		msg *dnsMsg
+		err error
+	}
+	reads := make(chan read, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					msg, _, err := conn.ReadPacketFrom()
+					reads <- read{msg, err}
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	next := func() read {
+		select {
+		case r := <-reads:
+			return r
+		case <-time.After(2 * time.Second):
+			t.Fatal("nothing read")
+		}
+		return read{}
+	}
+
+	// two queries in one segment, each after its two-byte length
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := []byte{}
+	names := []string{"one.example.com.", "two.example.com."}
+	for i, name := range names {
+		pack, _ := testTCPQuery(uint16(100+i), name).Pack()
+		frames = append(frames, byte(len(pack)>>8), byte(len(pack)))
+		frames = append(frames, pack...)
+	}
+	if _, err := conn.Write(frames); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		r := next()
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.msg.id != uint16(100+i) || r.msg.question[0].Name != name {
+			t.Errorf("read %s", r.msg.String())
+		}
+	}
+
+	// a frame cut short
+	conn.Write([]byte{0, 100, 1, 2, 3})
+	conn.Close()
+	if r := next(); r.err == nil {
+		t.Errorf("read %s from a short frame", r.msg.String())
+	}
+
+	// a frame too short for a message
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0, 2, 0, 0})
+	if r := next(); r.err == nil {
+		t.Errorf("read %s from a bad message", r.msg.String())
+	}
+
+	// framed the same way by the client
+	tconn, err := dialTCPDNS(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tconn.Close()
+	if err := tconn.WritePacketTo(testTCPQuery(102, "three.example.com."), nil); err != nil {
+		t.Fatal(err)
+	}
+	if r := next(); r.err != nil || r.msg.question[0].Name != "three.example.com." {
+		t.Errorf("read %v, %v", r.msg, r.err)
+	}
+	// no length can tell more than 0xFFFF bytes
+	if err := tconn.Write(make([]byte, 0x10000)); err == nil {
+		t.Error("oversized message written")
+	}
+}
+
+func Test_accept_retryable(t *testing.T) {
+	accept := func(err error) error {
+		return &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", err)}
+	}
+	cases := []struct {
+		err   error
+		retry bool
+	}{
+		{accept(syscall.EMFILE), true},
+		{accept(syscall.ECONNABORTED), true},
+		{timeoutError{}, true},
+		{accept(syscall.EINVAL), false},
+		{net.ErrClosed, false},
+		{errors.New("bad"), false},
+	}
+	for _, c := range cases {
+		if retry := acceptRetryable(c.err); retry != c.retry {
+			t.Errorf("%v: retry %t", c.err, retry)
+		}
+	}
+}
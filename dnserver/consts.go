@@ -1,5 +1,10 @@
 package toydns
 
+import (
+    "strconv"
+    "strings"
+)
+
 const (
     // valid dnsRR_Header.Rrtype and dnsQuestion.qtype
     dnsTypeA     = 1
@@ -51,6 +56,23 @@ const (
     _TC = 1 << 9  // truncated
     _RD = 1 << 8  // recursion desired
     _RA = 1 << 7  // recursion available
+    _AD = 1 << 5  // authentic data
+    _CD = 1 << 4  // checking disabled
+
+    // dnsRR_OPT TTL flags
+    _DO = 1 << 15 // DNSSEC OK
+)
+
+const (
+    // EDNS0 option codes
+    dnsOptionSubnet = 8 // client subnet, RFC 7871
+)
+
+const (
+    // the largest UDP message without EDNS0
+    dnsMinUDPSize = 512
+    // default for srvConfig.EDNSBufferSize, as suggested by DNS flag day 2020
+    dnsDefaultEDNSSize = 1232
 )
 
 var _dnsTypeString map[uint16]string = map[uint16]string{
@@ -80,6 +102,22 @@ func dnsTypeString(dnstype uint16) string {
     if ok {
         return s
     } else {
-        return "UNKNOWN"
+        return "TYPE" + strconv.Itoa(int(dnstype))
+    }
+}
+
+func dnsTypeFromString(s string) (uint16, bool) {
+    s = strings.ToUpper(s)
+    for t, name := range _dnsTypeString {
+        if name == s {
+            return t, true
+        }
+    }
+    // RFC 3597 generic type, TYPEnnn
+    if strings.HasPrefix(s, "TYPE") {
+        if t, err := strconv.ParseUint(s[4:], 10, 16); err == nil {
+            return uint16(t), true
+        }
     }
+    return 0, false
 }
@@ -0,0 +1,270 @@
+package toydns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Runtime administration over HTTP on a unix socket:
+//
+//	GET  /cache?suffix=example.com        list entries
+//	POST /cache/flush?name=www.example.com flush a name
+//	POST /cache/flush?suffix=example.com   flush a name and all under it
+//	POST /cache/flush?all=true             flush everything
+//	POST /cache/pin?name=&type=&ttl=&data= pin a static answer, data may
+//	                                       be repeated for an RRset
+
+// default TTL of pinned records
+const pinDefaultTTL = 60
+
+func (self *DNSServer) startControl(path string) error {
+	// a socket left over by an unclean exit
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	// bound in a directory of our own and moved in place once private,
+	// no one else can connect in between
+	dir, err := ioutil.TempDir(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "control")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return err
+	}
+	// removed by us at shutdown, by then it is no longer at tmp
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	self.controlLn = ln
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache", self.controlList)
+	mux.HandleFunc("/cache/flush", self.controlFlush)
+	mux.HandleFunc("/cache/pin", self.controlPin)
+	logger.Info("Control interface on %s", path)
+	go http.Serve(ln, mux)
+	return nil
+}
+
+func controlReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func controlError(w http.ResponseWriter, status int, err error) {
+	controlReply(w, status, map[string]string{"error": err.Error()})
+}
+
+func (self *DNSServer) controlList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		controlError(w, http.StatusMethodNotAllowed, errors.New("GET only"))
+		return
+	}
+	controlReply(w, http.StatusOK, self.cache.List(r.FormValue("suffix")))
+}
+
+func (self *DNSServer) controlFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		controlError(w, http.StatusMethodNotAllowed, errors.New("POST only"))
+		return
+	}
+	var n int
+	switch {
+	case r.FormValue("all") == "true":
+		n = self.cache.FlushAll()
+	case r.FormValue("name") != "":
+		n = self.cache.Flush(r.FormValue("name"), false)
+	case r.FormValue("suffix") != "":
+		n = self.cache.Flush(r.FormValue("suffix"), true)
+	default:
+		controlError(w, http.StatusBadRequest, errors.New("name, suffix or all required"))
+		return
+	}
+	logger.Notice("Flushed %d cache entries (%s)", n, r.Form.Encode())
+	controlReply(w, http.StatusOK, map[string]int{"flushed": n})
+}
+
+func (self *DNSServer) controlPin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		controlError(w, http.StatusMethodNotAllowed, errors.New("POST only"))
+		return
+	}
+	r.ParseForm()
+	name := r.Form.Get("name")
+	if name == "" || len(r.Form["data"]) == 0 {
+		controlError(w, http.StatusBadRequest, errors.New("name and data required"))
+		return
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	t, ok := dnsTypeFromString(strings.ToUpper(r.Form.Get("type")))
+	if !ok || t == dnsTypeOPT {
+		controlError(w, http.StatusBadRequest, fmt.Errorf("bad type %q", r.Form.Get("type")))
+		return
+	}
+	ttl := pinDefaultTTL
+	if sttl := r.Form.Get("ttl"); sttl != "" {
+		var err error
+		if ttl, err = parseTTL(sttl); err != nil {
+			controlError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	msg := new(dnsMsg)
+	msg.response = true
+	msg.recursion_available = true
+	msg.question = []dnsQuestion{{name, t, dnsClassINET}}
+	for _, data := range r.Form["data"] {
+		rr, err := pinRR(name, int(t), ttl, data)
+		if err != nil {
+			controlError(w, http.StatusBadRequest, err)
+			return
+		}
+		msg.answer = append(msg.answer, rr)
+	}
+	pack, err := msg.Pack()
+	if err != nil {
+		controlError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	self.cache.Pin(name, int(t), pack)
+	logger.Notice("Pinned %s[%s] to %v", name, dnsTypeString(t), r.Form["data"])
+	controlReply(w, http.StatusOK, self.cache.List(name))
+}
+
+// a record from presentation format rdata, as in the records file
+func pinRR(name string, rrtype int, ttl int, data string) (dnsRR, error) {
+	fields := strings.Fields(data)
+	if len(fields) == 0 {
+		return nil, errors.New("empty data")
+	}
+	return newRR(name, rrtype, ttl, recordRdata(rrtype, fields))
+}
+
+// Control runs a control command against the server of configFile and
+// prints the result to out:
+//
+//	cache list [suffix]
+//	cache flush name|suffix <name>
+//	cache flush all
+//	cache pin <name> <type> <ttl> <rdata>...
+func Control(configFile string, args []string, out io.Writer, _log _Logger) error {
+	if _log == nil {
+		return errors.New("No logger specified")
+	}
+	logger = _log
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if cfg.ControlSocket == "" {
+		return errors.New("control_socket not configured")
+	}
+
+	usage := errors.New("usage: cache list [suffix] | cache flush name|suffix <name> | " +
+		"cache flush all | cache pin <name> <type> <ttl> <rdata>...")
+	if len(args) < 2 || args[0] != "cache" {
+		return usage
+	}
+
+	method, path, form := "POST", "", url.Values{}
+	switch {
+	case args[1] == "list" && len(args) <= 3:
+		method, path = "GET", "/cache"
+		if len(args) == 3 {
+			form.Set("suffix", args[2])
+		}
+	case args[1] == "flush" && len(args) == 3 && args[2] == "all":
+		path = "/cache/flush"
+		form.Set("all", "true")
+	case args[1] == "flush" && len(args) == 4 && (args[2] == "name" || args[2] == "suffix"):
+		path = "/cache/flush"
+		form.Set(args[2], args[3])
+	case args[1] == "pin" && len(args) >= 6:
+		path = "/cache/pin"
+		form.Set("name", args[2])
+		form.Set("type", args[3])
+		form.Set("ttl", args[4])
+		form.Set("data", strings.Join(args[5:], " "))
+	default:
+		return usage
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", cfg.ControlSocket)
+		},
+	}}
+	var resp *http.Response
+	if method == "GET" {
+		resp, err = client.Get("http://toydns" + path + "?" + form.Encode())
+	} else {
+		resp, err = client.PostForm("http://toydns"+path, form)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e map[string]string
+		if json.Unmarshal(body, &e) == nil && e["error"] != "" {
+			return errors.New(e["error"])
+		}
+		return errors.New(resp.Status)
+	}
+
+	if path == "/cache/flush" {
+		var r map[string]int
+		json.Unmarshal(body, &r)
+		fmt.Fprintf(out, "flushed %d entries\n", r["flushed"])
+		return nil
+	}
+	var entries []cacheEntryInfo
+	if err = json.Unmarshal(body, &entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		flags := e.Kind
+		if e.Pinned {
+			flags += " pinned"
+		} else if e.TTL < 0 {
+			flags += " stale"
+		}
+		fmt.Fprintf(out, "%s\tttl %d\thits %d\t%s\n", e.Key, e.TTL, e.Hits, flags)
+		for _, rr := range e.Records {
+			fmt.Fprintf(out, "\t%s\n", rr)
+		}
+	}
+	return nil
+}
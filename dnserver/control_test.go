@@ -0,0 +1,54 @@
+package toydns
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_control_socket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "toydns.sock")
+	srv := newTestServer()
+	srv.cfg.ControlSocket = path
+	if err := srv.startControl(path); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("control socket mode %v", fi.Mode())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("%d files next to the socket", len(entries))
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://toydns/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("list %s", resp.Status)
+	}
+
+	// in use, not taken over
+	if err := newTestServer().startControl(path); err == nil {
+		t.Error("control socket in use taken over")
+	}
+
+	srv.Shutdown()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("control socket left at shutdown: %v", err)
+	}
+}
@@ -1,11 +1,15 @@
 package toydns
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/howeyc/fsnotify"
@@ -15,6 +19,9 @@ var logger _Logger
 
 var _rdblock sync.RWMutex
 
+// how long an idle TCP client connection is kept open
+const tcpIdleTimeout = 10 * time.Second
+
 type random struct {
 	R *rand.Rand
 }
@@ -26,14 +33,24 @@ func (self *random) Uint16() uint16 {
 type DNSServer struct {
 	cfg       *srvConfig
 	conn      dnsConn
+	tcpLn     *tcpDNSListener
 	r         *random
 	rdb       *domainDB
 	cache     *dnsCache
-	upstreams []*upstreamEntry
+	inflight  *flightGroup
+	upstreams *upstreamGroup
+	groups    map[string]*upstreamGroup // by name
+	// upstreams of the records file by address
+	upstreamReg  map[string]*upstreamEntry
+	upstreamLock sync.Mutex
+	controlLn    net.Listener
+	ttlTree      *suffixTreeNode // per suffix *ttlOverride
+	done         chan bool       // closed on shutdown
+	shutdown     sync.Once
 }
 
 func NewServer(configFile string, _log _Logger) (*DNSServer, error) {
-	dns := &DNSServer{}
+	dns := &DNSServer{done: make(chan bool)}
 	if _log == nil {
 		return nil, errors.New("No logger specified")
 	}
@@ -51,41 +68,61 @@ func (self *DNSServer) initServer(configFile string) error {
 	}
 	self.cfg = cfg
 
-	self.conn, err = listenDNS(cfg.Listen)
-	if err != nil {
-		return err
+	if cfg.Listen.Protocol != PROTO_TCP {
+		self.conn, err = listenDNS(cfg.Listen, cfg.EDNSBufferSize)
+		if err != nil {
+			return err
+		}
+		logger.Info("Start Listening on %v", self.conn)
 	}
 
-	logger.Info("Start Listening on %v", self.conn)
+	if cfg.Listen.Protocol == PROTO_TCP || cfg.Listen.Protocol == PROTO_DNS {
+		addr := fmt.Sprintf("%s:%d", cfg.Listen.Addr, cfg.Listen.Port)
+		self.tcpLn, err = listenTCPDNS(addr)
+		if err != nil {
+			return err
+		}
+		logger.Info("Start Listening on %v", self.tcpLn)
+	}
 
 	self.rdb = nil
-	if cfg.RecordFile != "" {
+	if cfg.RecordFile != "" || len(cfg.Zones) > 0 {
 
 		fatal := func(err error) {
 			logger.Fatal(err)
 		}
 
 		readDB := func() {
-			db, err := readRecordsFile(cfg.RecordFile)
+			db, err := readDomainDB(cfg)
 			if err == nil {
 				_rdblock.Lock()
 				self.rdb = db
 				_rdblock.Unlock()
+			} else {
+				logger.Error("Failed to read records: %s", err.Error())
 			}
 		}
 		readDB()
 
-		//Watch record file modify and update record db
+		//Watch record and zone files modify and update record db
 		watcher, err := fsnotify.NewWatcher()
 		if err != nil {
 			fatal(err)
 			return err
 		}
 
-		err = watcher.Watch(cfg.RecordFile)
-		if err != nil {
-			fatal(err)
-			return err
+		files := []string{}
+		if cfg.RecordFile != "" {
+			files = append(files, cfg.RecordFile)
+		}
+		for _, z := range cfg.Zones {
+			files = append(files, z.File)
+		}
+		for _, f := range files {
+			if err = watcher.Watch(f); err != nil {
+				fatal(err)
+				return err
+			}
 		}
 		go func() {
 			for {
@@ -102,39 +139,245 @@ func (self *DNSServer) initServer(configFile string) error {
 		}()
 	}
 
-	self.cache = newDNSCache()
+	self.cache = newDNSCache(cfg.CacheSize, cfg.CacheMemory)
+	self.cache.staleWindow = cfg.ServeStale
+	self.cache.prefetchHits = cfg.PrefetchHits
+	self.cache.prefetchRatio = cfg.PrefetchRatio
+	self.cache.startSweeper(time.Duration(cfg.CacheSweepInterval)*time.Second, self.done)
+	if cfg.CacheFile != "" {
+		if n, err := self.cache.Load(cfg.CacheFile); err == nil {
+			logger.Info("Loaded %d cache entries from %s", n, cfg.CacheFile)
+		} else if !os.IsNotExist(err) {
+			logger.Warning("Failed to load cache: %s", err.Error())
+		}
+		self.cache.startSaver(cfg.CacheFile, time.Duration(cfg.CacheSaveInterval)*time.Second, self.done)
+	}
+	self.inflight = newFlightGroup()
+
+	self.ttlTree = newSuffixTree("", nil)
+	for i := range cfg.TTLOverrides {
+		o := &cfg.TTLOverrides[i]
+		suffix := strings.Trim(strings.ToLower(o.Suffix), ".")
+		self.ttlTree.sinsert(strings.Split(suffix, "."), o)
+	}
+
+	if cfg.ControlSocket != "" {
+		if err := self.startControl(cfg.ControlSocket); err != nil {
+			return err
+		}
+	}
 
 	r := new(random)
 	r.R = rand.New(rand.NewSource(time.Now().Unix()))
 	self.r = r
 
-	self.upstreams = make([]*upstreamEntry, 0, 4)
+	upstreams := make([]*upstreamEntry, 0, 4)
 	for _, e := range cfg.Upstreams {
 		upstream := newUpstreamEntry(e)
-		self.upstreams = append(self.upstreams, upstream)
+		upstreams = append(upstreams, upstream)
+	}
+	self.upstreams = newUpstreamGroup("", cfg.Selection, upstreams)
+
+	self.groups = make(map[string]*upstreamGroup)
+	for _, g := range cfg.UpstreamGroups {
+		entries := make([]*upstreamEntry, 0, len(g.Upstreams))
+		for _, e := range g.Upstreams {
+			entries = append(entries, newUpstreamEntry(e))
+		}
+		selection := g.Selection
+		if selection == "" {
+			selection = cfg.Selection
+		}
+		self.groups[g.Name] = newUpstreamGroup(g.Name, selection, entries)
 	}
 
 	return nil
 }
 
 func (self *DNSServer) ServeForever() error {
+	if self.conn == nil {
+		return self.serveTCP()
+	}
+
+	if self.tcpLn != nil {
+		go self.serveTCP()
+	}
 
 	for {
 		msg, clientAddr, err := self.conn.ReadPacketFrom()
 		if err != nil {
+			if self.closing() {
+				return nil
+			}
 			continue
 		}
-		go self.handleClient(msg, clientAddr)
+		go self.handleClient(self.conn, msg, clientAddr)
 	}
+}
 
-	return errors.New("Here should not be reached")
+// save the cache and stop listening, ServeForever returns after it
+func (self *DNSServer) Shutdown() error {
+	var err error
+	// only once, however many signals come in
+	self.shutdown.Do(func() {
+		if self.cfg.CacheFile != "" {
+			var n int
+			if n, err = self.cache.Save(self.cfg.CacheFile); err == nil {
+				logger.Info("Saved %d cache entries to %s", n, self.cfg.CacheFile)
+			} else {
+				logger.Error("Failed to save cache: %s", err.Error())
+			}
+		}
+
+		close(self.done)
+		if self.conn != nil {
+			self.conn.Close()
+		}
+		if self.tcpLn != nil {
+			self.tcpLn.Close()
+		}
+		if self.controlLn != nil {
+			self.controlLn.Close()
+			os.Remove(self.cfg.ControlSocket)
+		}
+		self.closeUpstreams()
+	})
+	return err
+}
+
+func (self *DNSServer) closing() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *DNSServer) serveTCP() error {
+	var backoff time.Duration
+	for {
+		conn, err := self.tcpLn.Accept()
+		if err != nil {
+			if self.closing() || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if acceptRetryable(err) {
+				// from 5ms doubling up to a second, until some
+				// connections are closed
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else {
+					backoff *= 2
+				}
+				if backoff > time.Second {
+					backoff = time.Second
+				}
+				logger.Warning("Error accepting TCP connection: %s, retrying in %v", err.Error(), backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			logger.Error("Error accepting TCP connection: %s", err.Error())
+			return err
+		}
+		backoff = 0
+		go self.serveTCPConn(conn)
+	}
 }
 
-func (self *DNSServer) handleClient(dnsq *dnsMsg, clientAddr net.Addr) {
+// whether Accept may work again later: it timed out, ran out of file
+// descriptors or buffers, or the client was gone before it was accepted
+func acceptRetryable(err error) bool {
+	var neterr net.Error
+	if errors.As(err, &neterr) && neterr.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// serve queries from one TCP client until it goes idle or closes
+func (self *DNSServer) serveTCPConn(conn *tcpDNSConn) {
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		conn.Close()
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		msg, clientAddr, err := conn.ReadPacketFrom()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			self.handleClient(conn, msg, clientAddr)
+		}()
+	}
+}
+
+func (self *DNSServer) handleClient(conn dnsConn, dnsq *dnsMsg, clientAddr net.Addr) {
+	if len(dnsq.question) == 0 {
+		return
+	}
 	qid := dnsq.id
 
+	dnsmsg, _ := dnsq.Reply()
+	if dnsq.opt() != nil {
+		dnsmsg.setOPT(newOPT(self.cfg.EDNSBufferSize, false))
+	}
+
+	//try local look up first, names in local domains never go upstream
+	if len(dnsmsg.question) == 1 {
+		q := dnsmsg.question[0]
+		ans := make([]dnsRR, 0, 10)
+		result := queryNotOwned
+		var soa dnsRR
+		_rdblock.RLock()
+		if self.rdb != nil {
+			var dkey string
+			result, dkey = queryDB(q.Name, int(q.Qtype), self.rdb, &ans)
+			if result == queryNoData || result == queryNXDomain {
+				soa = self.rdb.domains[dkey].negativeSOA()
+			}
+		}
+		_rdblock.RUnlock()
+
+		if result != queryNotOwned {
+			dnsmsg.authoritative = true
+			dnsmsg.answer = ans
+			if soa != nil {
+				dnsmsg.ns = []dnsRR{soa}
+			}
+			if result == queryNXDomain {
+				dnsmsg.rcode = dnsRcodeNameError
+			}
+			logger.Info("Query %s[%s] from %s [LOCAL]",
+				q.Name, dnsTypeString(q.Qtype), clientAddr.String())
+			pack, _ := dnsmsg.Pack()
+			logger.Debug(dnsmsg.String())
+			// not cached, local lookups are cheap and RRsets are reordered per query
+			self.writeReply(conn, dnsq, pack, clientAddr)
+			return
+		}
+	}
+
 	//try cache
-	cpack, found := self.cache.Get(dnsq.question[0].Name, int(dnsq.question[0].Qtype))
+	cq := newCacheQuestion(dnsq)
+	cpack, found := self.cache.Get(cq)
+	// a cached failure, the answer it replaced is better if we have it
+	if found && servFailed(cpack) && self.serveStale(conn, dnsq, clientAddr) {
+		return
+	}
 	if found {
 		cpack[0] = byte(qid >> 8)
 		cpack[1] = byte(qid)
@@ -143,48 +386,54 @@ func (self *DNSServer) handleClient(dnsq *dnsMsg, clientAddr net.Addr) {
 			dnsTypeString(dnsq.question[0].Qtype),
 			clientAddr.String(),
 		)
-		self.conn.WriteTo(cpack, clientAddr)
+		self.writeReply(conn, dnsq, cpack, clientAddr)
+		if self.cache.ShouldPrefetch(cq) {
+			logger.Debug("Prefetching %s[%s]", dnsq.question[0].Name,
+				dnsTypeString(dnsq.question[0].Qtype))
+			go self.resolve(dnsq)
+		}
 		return
 	}
 
+	// upstreams failed on this lately, don't keep the client waiting
+	q := dnsq.question[0]
+	if self.cache.Failing(cq) {
+		if self.serveStale(conn, dnsq, clientAddr) {
+			go self.refresh(dnsq)
+			return
+		}
+	}
+
 	logger.Info("Query %s[%s] from %s [MISS]",
 		dnsq.question[0].Name,
 		dnsTypeString(dnsq.question[0].Qtype),
 		clientAddr.String())
 
-	//try local look up
-	upstreamEntries := []*upstreamEntry{}
-	dnsmsg, _ := dnsq.Reply()
-	if len(dnsmsg.question) == 1 && self.rdb != nil {
-		q := dnsmsg.question[0]
-		ans := make([]dnsRR, 0, 10)
-		_rdblock.RLock()
-		found := queryDB(q.Name, int(q.Qtype), self.rdb, &ans)
-		_rdblock.RUnlock()
-
-		if found {
-			dnsmsg.answer = ans
-			pack, _ := dnsmsg.Pack()
-			logger.Debug(dnsmsg.String())
-			self.conn.WriteTo(pack, clientAddr)
-			self.cache.Insert(q.Name, int(q.Qtype), pack, int(ans[0].Header().Ttl))
+	replyMsg, err, shared := self.resolve(dnsq)
+	if err == nil && servFailed(replyMsg) {
+		self.cache.MarkFailed(cq)
+		if self.serveStale(conn, dnsq, clientAddr) {
 			return
 		}
-
-		// found upstream
-		if uaddr, ok := getUpstreamAddr(q.Name); ok {
-			upstreamEntries = append(upstreamEntries, newUpstreamEntry(uaddr))
+	}
+	if err == nil {
+		if shared {
+			logger.Debug("Reply for %s[%s] shared with concurrent queries",
+				q.Name, dnsTypeString(q.Qtype))
+			// every waiter gets its own copy carrying its own ID and
+			// question as it asked, in case of 0x20 casing
+			replyMsg = append([]byte(nil), replyMsg...)
+			replyMsg[0] = byte(qid >> 8)
+			replyMsg[1] = byte(qid)
+			setQuestion(replyMsg, q.Name, int(q.Qtype))
 		}
+		self.writeReply(conn, dnsq, replyMsg, clientAddr)
+		return
 	}
 
-	upstreamEntries = append(upstreamEntries, self.upstreams...)
-	for _, upstream := range upstreamEntries {
-		if replyMsg, err := self.questionUpstream(upstream, *dnsq); err == nil {
-			self.conn.WriteTo(replyMsg, clientAddr)
-			return
-		} else {
-			logger.Error(upstream.udpAddr + err.Error())
-		}
+	self.cache.MarkFailed(cq)
+	if self.serveStale(conn, dnsq, clientAddr) {
+		return
 	}
 
 	// Query Failed
@@ -193,76 +442,496 @@ func (self *DNSServer) handleClient(dnsq *dnsMsg, clientAddr net.Addr) {
 		dnsTypeString(dnsq.question[0].Qtype),
 		clientAddr.String())
 	dnsmsg.rcode = dnsRcodeServerFailure
-	self.conn.WritePacketTo(dnsmsg, clientAddr)
+	pack, _ := dnsmsg.Pack()
+	self.writeReply(conn, dnsq, pack, clientAddr)
 	return
 
 }
 
-func (self *DNSServer) questionUpstream(entry *upstreamEntry, dnsq dnsMsg) ([]byte, error) {
-	conn, err := dialUpstream(entry)
-	if err != nil {
-		return nil, err
+// forward a question upstream, only one upstream query for identical
+// questions at a time
+func (self *DNSServer) resolve(dnsq *dnsMsg) (replyMsg []byte, err error, shared bool) {
+	cq := newCacheQuestion(dnsq)
+	return self.inflight.Do(
+		cq.key(cachePositive),
+		func() ([]byte, error) { return self.forward(dnsq) },
+	)
+}
+
+// whether a packed reply is a SERVFAIL
+func servFailed(pack []byte) bool {
+	return len(pack) >= 4 && int(pack[3]&0xF) == dnsRcodeServerFailure
+}
+
+// an upstream replied, but with an error instead of an answer
+type rcodeError int
+
+func (self rcodeError) Error() string {
+	return fmt.Sprintf("Upstream replied with rcode %d", int(self))
+}
+
+// nil for an answer, NOERROR or NXDOMAIN, a rcodeError otherwise
+func replyError(dnsmsg *dnsMsg) error {
+	if dnsmsg.rcode == dnsRcodeSuccess || dnsmsg.rcode == dnsRcodeNameError {
+		return nil
 	}
-	// logger.Debug("%s", dnsq)
-	qid := dnsq.id
-	msg, _ := dnsq.Pack()
+	return rcodeError(dnsmsg.rcode)
+}
 
-	for i := 0; i < self.cfg.Repeat; i++ {
-		conn.Write(msg)
+// refresh a stale cache entry in background
+func (self *DNSServer) refresh(dnsq *dnsMsg) {
+	if pack, err, _ := self.resolve(dnsq); err != nil || servFailed(pack) {
+		self.cache.MarkFailed(newCacheQuestion(dnsq))
 	}
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+}
 
-	upMsg, err := conn.Read()
+// answer with expired data if we still have it
+func (self *DNSServer) serveStale(conn dnsConn, dnsq *dnsMsg, clientAddr net.Addr) bool {
+	q := dnsq.question[0]
+	spack, found := self.cache.GetStale(newCacheQuestion(dnsq))
+	if !found {
+		return false
+	}
+	spack[0] = byte(dnsq.id >> 8)
+	spack[1] = byte(dnsq.id)
+	logger.Info("Query %s[%s] from %s [STALE]",
+		q.Name, dnsTypeString(q.Qtype), clientAddr.String())
+	self.writeReply(conn, dnsq, spack, clientAddr)
+	return true
+}
 
-	if err != nil {
-		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-			logger.Warning("Upstream %v Timeout", conn)
+// ask upstreams for an answer as the strategy says
+func (self *DNSServer) forward(dnsq *dnsMsg) ([]byte, error) {
+	timeout := time.Duration(self.cfg.UpstreamTimeout) * time.Millisecond
+	upstreamEntries := []*upstreamEntry{}
+	if uaddr, ok := getUpstreamAddr(dnsq.question[0].Name); ok {
+		if strings.HasPrefix(uaddr, "@") {
+			if g, found := self.groups[uaddr[1:]]; found {
+				upstreamEntries = append(upstreamEntries, g.ordered(timeout)...)
+			} else {
+				logger.Warning("Unknown upstream group %s", uaddr)
+			}
 		} else {
-			logger.Error("Error Reading from upstream: %s", err.Error())
+			upstreamEntries = append(upstreamEntries, self.upstreamByAddr(uaddr))
 		}
-		return nil, err
 	}
+	upstreamEntries = healthyUpstreams(append(upstreamEntries, self.upstreams.ordered(timeout)...))
 
-	if len(upMsg) < 12 {
-		err = errors.New("Invalid reply message")
-		logger.Error(err.Error())
-		return nil, err
+	// an error reply like SERVFAIL, given only if no upstream answers
+	var failed []byte
+
+	if self.cfg.Strategy == STRATEGY_RACE {
+		// race_count of them at a time, the next ones if all of them fail
+		for i := 0; i < len(upstreamEntries); i += self.cfg.RaceCount {
+			end := i + self.cfg.RaceCount
+			if end > len(upstreamEntries) {
+				end = len(upstreamEntries)
+			}
+			replyMsg, err := self.race(upstreamEntries[i:end], dnsq)
+			if err == nil {
+				return replyMsg, nil
+			}
+			if replyMsg != nil && failed == nil {
+				failed = replyMsg
+			}
+		}
+	} else {
+		for _, upstream := range upstreamEntries {
+			replyMsg, err := self.questionUpstream(upstream, *dnsq)
+			if err == nil {
+				return replyMsg, nil
+			}
+			logger.Error(upstream.addr + err.Error())
+			if replyMsg != nil && failed == nil {
+				failed = replyMsg
+			}
+		}
 	}
 
-	if qid != uint16(upMsg[0])<<8+uint16(upMsg[1]) {
-		err = errors.New("Invalid return id")
+	if failed != nil {
+		return failed, nil
+	}
+	return nil, errors.New("All upstreams failed")
+}
+
+// ask all upstreams at once, the first good answer wins; an error
+// reply comes back with its error if none answers
+func (self *DNSServer) race(upstreamEntries []*upstreamEntry, dnsq *dnsMsg) ([]byte, error) {
+	type result struct {
+		pack []byte
+		err  error
+	}
+	// buffered so the losers never block
+	results := make(chan result, len(upstreamEntries))
+	for _, upstream := range upstreamEntries {
+		go func(upstream *upstreamEntry) {
+			replyMsg, err := self.questionUpstream(upstream, *dnsq)
+			if err != nil {
+				logger.Error(upstream.addr + err.Error())
+			}
+			results <- result{replyMsg, err}
+		}(upstream)
+	}
+
+	var err error
+	var failed []byte
+	for range upstreamEntries {
+		r := <-results
+		if r.err == nil {
+			return r.pack, nil
+		}
+		if r.pack != nil && failed == nil {
+			failed = r.pack
+		}
+		err = r.err
+	}
+	return failed, err
+}
+
+// the largest reply the client can receive on conn
+func (self *DNSServer) maxReplySize(conn dnsConn, dnsq *dnsMsg) int {
+	if _, ok := conn.(*tcpDNSConn); ok {
+		return 0xFFFF
+	}
+
+	size := dnsMinUDPSize
+	if opt := dnsq.opt(); opt != nil && opt.UDPSize() > size {
+		size = opt.UDPSize()
+	}
+	if size > self.cfg.EDNSBufferSize {
+		size = self.cfg.EDNSBufferSize
+	}
+	return size
+}
+
+// write a packed reply, truncating it to what the client can receive
+// and dropping OPT if the client did not speak EDNS0
+func (self *DNSServer) writeReply(conn dnsConn, dnsq *dnsMsg, pack []byte, clientAddr net.Addr) error {
+	size := self.maxReplySize(conn, dnsq)
+	qopt := dnsq.opt()
+	if len(pack) <= size && (qopt != nil || len(pack) < 12 || binary.BigEndian.Uint16(pack[10:]) == 0) {
+		return conn.WriteTo(pack, clientAddr)
+	}
+
+	reply := new(dnsMsg)
+	if _, err := reply.Unpack(pack, 0); err != nil {
 		logger.Error(err.Error())
-		return nil, err
+		return err
+	}
+	if qopt == nil {
+		reply.setOPT(nil)
 	}
 
-	dnsmsg := new(dnsMsg)
-	_, err = dnsmsg.Unpack(upMsg, 0)
+	pack, err := reply.PackTruncated(size)
 	if err != nil {
 		logger.Error(err.Error())
-		return nil, err
+		return err
 	}
-	if gfwPolluted(dnsmsg) {
-		err = fmt.Errorf("GFW polluted %s", dnsmsg)
-		logger.Error(err.Error())
+	return conn.WriteTo(pack, clientAddr)
+}
+
+// ask one upstream and cache what it replies; an error reply like
+// SERVFAIL is returned along with a rcodeError
+func (self *DNSServer) questionUpstream(entry *upstreamEntry, dnsq dnsMsg) ([]byte, error) {
+	start := time.Now()
+	upMsg, dnsmsg, err := self.exchangeUpstream(entry, dnsq)
+	if err == nil {
+		// an error reply counts against the upstream all the same
+		err = replyError(dnsmsg)
+	}
+	entry.observe(time.Since(start), err)
+	self.reportUpstream(entry, err)
+	if dnsmsg == nil {
 		return nil, err
 	}
 
-	if len(dnsmsg.question) == 0 {
-		return nil, errors.New("Invalid Question")
+	// retry over TCP to get the complete answer
+	if dnsmsg.truncated && entry.protocol != PROTO_TCP && entry.protocol != PROTO_CRYPT {
+		logger.Debug("Truncated reply from %s, retrying over TCP", entry.addr)
+		tcpEntry := &upstreamEntry{
+			protocol: PROTO_TCP,
+			addr:     entry.addr,
+			timeout:  entry.timeout,
+			retries:  entry.retries,
+			deadline: entry.deadline,
+		}
+		start = time.Now()
+		tcpMsg, tcpdnsmsg, err := self.exchangeUpstream(tcpEntry, dnsq)
+		if err == nil {
+			upMsg, dnsmsg = tcpMsg, tcpdnsmsg
+			err = replyError(dnsmsg)
+		} else {
+			logger.Warning("TCP fallback to %s failed: %s", entry.addr, err.Error())
+		}
+		// a dead TCP path counts against the upstream as UDP would
+		entry.observe(time.Since(start), err)
+		self.reportUpstream(entry, err)
+	}
+
+	// cached under the question asked, for the client subnet scope
+	// the answer is good for
+	cq := newCacheQuestion(&dnsq)
+	if cq.ecs != nil {
+		scope := 0
+		if ropt := dnsmsg.opt(); ropt != nil {
+			if ecs := ropt.Subnet(); ecs != nil {
+				scope = ecs.ScopePrefix
+			}
+		}
+		if scope < cq.scope {
+			cq.scope = scope
+		}
+	}
+	upMsg = self.ownOPT(dnsmsg, upMsg)
+	minTTL, maxTTL := self.ttlBounds(cq.name)
+	clampTTLs(upMsg, minTTL, maxTTL)
+
+	// a truncated answer is still better than nothing, but never cache it
+	if dnsmsg.truncated {
+		return upMsg, replyError(dnsmsg)
 	}
 
-	q := dnsmsg.question[0]
-	if len(dnsmsg.answer) > 0 {
-		logger.Debug("DNS Reply %s:%d", q.Name, q.Qtype)
-		self.cache.Insert(
-			q.Name, int(q.Qtype), upMsg,
-			int(dnsmsg.answer[0].Header().Ttl))
+	if kind, ttl, ok := self.cacheTTL(dnsmsg, minTTL, maxTTL); ok {
+		logger.Debug("DNS Reply %s:%d, cached for %ds", cq.qname, cq.qtype, ttl)
+		self.cache.Insert(cq, upMsg, ttl, kind)
 	} else {
 		logger.Debug(dnsmsg.String())
-		self.cache.Insert(
-			q.Name, int(q.Qtype), upMsg, 3)
 	}
 
-	return upMsg, nil
+	return upMsg, replyError(dnsmsg)
+
+}
+
+// the reply of an upstream as we give it to any client: OPT with our
+// own buffer size and without options, which upstream meant for the
+// client that asked
+func (self *DNSServer) ownOPT(dnsmsg *dnsMsg, upMsg []byte) []byte {
+	ropt := dnsmsg.opt()
+	if ropt == nil || (len(ropt.Options) == 0 && ropt.UDPSize() == self.cfg.EDNSBufferSize) {
+		return upMsg
+	}
+	opt := newOPT(self.cfg.EDNSBufferSize, false)
+	// extended rcode, version and DO
+	opt.Hdr.Ttl = ropt.Hdr.Ttl
+
+	reply := *dnsmsg
+	reply.setOPT(opt)
+	pack, err := reply.Pack()
+	if err != nil {
+		logger.Error(err.Error())
+		return upMsg
+	}
+	return pack
+}
+
+// how long and as what a reply can be cached, with TTLs bounded by
+// minTTL and maxTTL. Negative answers follow RFC 2308 and are only
+// cached with an SOA.
+func (self *DNSServer) cacheTTL(dnsmsg *dnsMsg, minTTL int, maxTTL int) (kind int, ttl int, ok bool) {
+	switch {
+	case dnsmsg.rcode == dnsRcodeServerFailure:
+		return cacheServFail, self.cfg.ServFailCacheTTL, self.cfg.ServFailCacheTTL > 0
+	case dnsmsg.rcode != dnsRcodeSuccess && dnsmsg.rcode != dnsRcodeNameError:
+		return 0, 0, false
+	case len(dnsmsg.answer) > 0:
+		// a CNAME chain ending in NXDOMAIN is specific to the type asked
+		return cachePositive, clampTTL(dnsmsg.minTTL(), minTTL, maxTTL), true
+	}
+
+	kind = cacheNoData
+	if dnsmsg.rcode == dnsRcodeNameError {
+		kind = cacheNXDomain
+	}
+	for _, rr := range dnsmsg.ns {
+		if soa, isSOA := rr.(*dnsRR_SOA); isSOA {
+			ttl = int(soa.Header().Ttl)
+			if int(soa.Minimum) < ttl {
+				ttl = int(soa.Minimum)
+			}
+			ttl = clampTTL(ttl, minTTL, maxTTL)
+			if ttl > self.cfg.NegativeCacheMaxTTL {
+				ttl = self.cfg.NegativeCacheMaxTTL
+			}
+			return kind, ttl, true
+		}
+	}
+	return kind, 0, false
+}
+
+// TTL bounds for names under qname, from the most specific override
+func (self *DNSServer) ttlBounds(qname string) (minTTL int, maxTTL int) {
+	minTTL, maxTTL = self.cfg.MinCacheTTL, self.cfg.MaxCacheTTL
+	if self.ttlTree == nil {
+		return
+	}
+	keys := strings.Split(strings.TrimSuffix(strings.ToLower(qname), "."), ".")
+	if v, found := self.ttlTree.search(keys); found {
+		o := v.(*ttlOverride)
+		if o.Min > 0 {
+			minTTL = o.Min
+		}
+		if o.Max > 0 {
+			maxTTL = o.Max
+		}
+	}
+	return
+}
+
+// ttl within bounds, 0 for no bound, the upper one wins
+func clampTTL(ttl int, minTTL int, maxTTL int) int {
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+// rewrite TTLs of all RRs in a packed message into bounds
+func clampTTLs(pack []byte, minTTL int, maxTTL int) {
+	if minTTL <= 0 && maxTTL <= 0 {
+		return
+	}
+	offs, err := ttlOffsets(pack)
+	if err != nil {
+		return
+	}
+	for _, off := range offs {
+		ttl := int(binary.BigEndian.Uint32(pack[off:]))
+		binary.BigEndian.PutUint32(pack[off:], uint32(clampTTL(ttl, minTTL, maxTTL)))
+	}
+}
+
+// send a query to upstream and read back a sane reply
+func (self *DNSServer) exchangeUpstream(entry *upstreamEntry, dnsq dnsMsg) ([]byte, *dnsMsg, error) {
+	// logger.Debug("%s", dnsq)
+	if len(dnsq.question) == 0 {
+		return nil, nil, errors.New("Invalid Question")
+	}
+
+	var ex upstreamExchange
+	if entry.protocol == PROTO_TCP {
+		conn, err := dialUpstream(entry, self.cfg.EDNSBufferSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		ex = &connExchange{conn, &dnsq, make(map[string]bool)}
+	} else {
+		var err error
+		ex, err = entry.udpPool(self.cfg.EDNSBufferSize).exchange(&dnsq)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	defer ex.Close()
+
+	// advertise our own buffer size, keeping the client's DO bit and
+	// subnet; other options like cookies are between client and us
+	opt := newOPT(self.cfg.EDNSBufferSize, false)
+	if qopt := dnsq.opt(); qopt != nil {
+		opt.SetDo(qopt.Do())
+		for _, o := range qopt.Options {
+			if o.Code == dnsOptionSubnet {
+				opt.Options = append(opt.Options, o)
+			}
+		}
+	}
+	dnsq.setOPT(opt)
+	msg, _ := dnsq.Pack()
+
+	repeat := self.cfg.Repeat
+	if entry.protocol == PROTO_TCP {
+		repeat = 1
+	}
+	timeout := entry.waitTime(time.Duration(self.cfg.UpstreamTimeout) * time.Millisecond)
+	var deadline time.Time
+	if entry.deadline > 0 {
+		deadline = time.Now().Add(entry.deadline)
+	}
+
+	var err error
+	for attempt := 0; attempt <= entry.retries; attempt++ {
+		if attempt > 0 {
+			timeout *= 2
+			logger.Debug("Asking %s again, waiting %v", entry.addr, timeout)
+		}
+		for i := 0; i < repeat; i++ {
+			ex.send(msg)
+		}
+		wait := time.Now().Add(timeout)
+		if !deadline.IsZero() && deadline.Before(wait) {
+			wait = deadline
+		}
+
+		var upMsg []byte
+		var dnsmsg *dnsMsg
+		upMsg, dnsmsg, err = ex.recv(wait)
+		if err == nil {
+			return upMsg, dnsmsg, nil
+		}
+		if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+			logger.Error("Error Reading from upstream: %s", err.Error())
+			return nil, nil, err
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			break
+		}
+	}
+	logger.Warning("Upstream %s Timeout", entry.addr)
+	return nil, nil, err
+}
+
+// the reply to query in upMsg, or false to skip it, like a forged
+// one or a copy of one seen, as an upstream sends one for each repeat
+// of the query
+func checkReply(upMsg []byte, query *dnsMsg, seen map[string]bool) (*dnsMsg, bool) {
+	if seen[string(upMsg)] {
+		return nil, false
+	}
+	seen[string(upMsg)] = true
+
+	if len(upMsg) < 12 {
+		logger.Error("Invalid reply message")
+		return nil, false
+	}
+	if query.id != uint16(upMsg[0])<<8+uint16(upMsg[1]) {
+		logger.Error("Invalid return id")
+		return nil, false
+	}
+
+	dnsmsg := new(dnsMsg)
+	if _, err := dnsmsg.Unpack(upMsg, 0); err != nil {
+		logger.Error(err.Error())
+		return nil, false
+	}
+	if !dnsmsg.response || dnsmsg.opcode != query.opcode {
+		logger.Error("Not a reply to %s: response %t, opcode %d",
+			query.question[0].Name, dnsmsg.response, dnsmsg.opcode)
+		return nil, false
+	}
+	// the question asked and nothing else, or the answer would be
+	// cached for a name it is not about
+	if len(dnsmsg.question) != len(query.question) {
+		logger.Error("Invalid Question")
+		return nil, false
+	}
+	for i, q := range query.question {
+		if rq := dnsmsg.question[i]; !sameQuestion(rq, q) {
+			logger.Error("Reply to %s[%s] for %s[%s]", rq.Name,
+				dnsTypeString(rq.Qtype), q.Name, dnsTypeString(q.Qtype))
+			return nil, false
+		}
+	}
+	if gfwPolluted(dnsmsg) {
+		logger.Error("GFW polluted %s", dnsmsg)
+		return nil, false
+	}
+	return dnsmsg, true
+}
 
+// names compared case-insensitively, the root unpacks as ""
+func sameQuestion(a dnsQuestion, b dnsQuestion) bool {
+	return strings.EqualFold(strings.TrimSuffix(a.Name, "."), strings.TrimSuffix(b.Name, ".")) &&
+		a.Qtype == b.Qtype && a.Qclass == b.Qclass
 }
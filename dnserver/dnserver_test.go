@@ -2,10 +2,26 @@ package toydns
 
 import (
     "fmt"
+    "reflect"
     "strings"
     "testing"
 )
 
+// print warnings and errors, the package logger is nil unless NewServer is called
+type testLogger struct{}
+
+func (l *testLogger) Debug(format string, args ...interface{})    {}
+func (l *testLogger) Info(format string, args ...interface{})     {}
+func (l *testLogger) Notice(format string, args ...interface{})   {}
+func (l *testLogger) Warning(format string, args ...interface{})  { fmt.Printf(format+"\n", args...) }
+func (l *testLogger) Error(format string, args ...interface{})    { fmt.Printf(format+"\n", args...) }
+func (l *testLogger) Critical(format string, args ...interface{}) { fmt.Printf(format+"\n", args...) }
+func (l *testLogger) Fatal(args ...interface{})                   { panic(fmt.Sprint(args...)) }
+
+func init() {
+    logger = new(testLogger)
+}
+
 func Test_rr_new(t *testing.T) {
     rr, err := newRR("test.example.com", dnsTypeA, 600, "192.168.0.1")
     if err != nil {
@@ -27,21 +43,100 @@ func Test_rr_new(t *testing.T) {
 
 }
 
+func Test_rr_pack(t *testing.T) {
+    msg := new(dnsMsg)
+    msg.response = true
+    msg.question = []dnsQuestion{{"example.com.", dnsTypeALL, dnsClassINET}}
+    rrs := []struct {
+        rrtype int
+        data   interface{}
+    }{
+        {dnsTypeMX, "10 mail.example.com."},
+        {dnsTypeTXT, []string{"v=spf1 -all", strings.Repeat("x", 300)}},
+        {dnsTypeSRV, []string{"0", "5", "5060", "sip.example.com."}},
+        {dnsTypePTR, "host.example.com."},
+        {dnsTypeSOA, "ns1.example.com. hostmaster.example.com. 2014010101 1h 10m 1d 300"},
+    }
+    for _, r := range rrs {
+        rr, err := newRR("example.com.", r.rrtype, 600, r.data)
+        if err != nil {
+            t.Fatalf("%s record failed with error: %s", dnsTypeString(uint16(r.rrtype)), err)
+        }
+        msg.answer = append(msg.answer, rr)
+    }
+
+    pack, err := msg.Pack()
+    if err != nil {
+        t.Fatal(err)
+    }
+    reply := new(dnsMsg)
+    if _, err := reply.Unpack(pack, 0); err != nil {
+        t.Fatal(err)
+    }
+    if len(reply.answer) != len(msg.answer) {
+        t.Fatalf("%d answers packed, %d unpacked", len(msg.answer), len(reply.answer))
+    }
+    for i, rr := range reply.answer {
+        fmt.Println(rr.String())
+        if rr.String() != msg.answer[i].String() {
+            t.Errorf("%s != %s", rr.String(), msg.answer[i].String())
+        }
+    }
+}
+
+func Test_rr_unknown(t *testing.T) {
+    rr, err := newRR("example.com.", 65, 300, `\# 6 0001 0000 0100`)
+    if err != nil {
+        t.Fatal("generic record failed with error:", err)
+    }
+    fmt.Println(rr.String())
+    if !strings.HasSuffix(rr.String(), `type: TYPE65, rdata: \# 6 000100000100}`) {
+        t.Error("bad presentation:", rr.String())
+    }
+
+    a, err := newRR("example.com.", dnsTypeA, 300, `\# 4 0a000001`)
+    if err != nil || a.Rdata().(uint32) != 0x0a000001 {
+        t.Error("generic A record failed:", err)
+    }
+
+    msg := new(dnsMsg)
+    msg.response = true
+    msg.question = []dnsQuestion{{"example.com.", 65, dnsClassINET}}
+    msg.answer = []dnsRR{rr, a}
+    pack, _ := msg.Pack()
+
+    reply := new(dnsMsg)
+    if _, err := reply.Unpack(pack, 0); err != nil {
+        t.Fatal(err)
+    }
+    repack, _ := reply.Pack()
+    if string(pack) != string(repack) {
+        t.Errorf("round trip changed the message:\n% x\n% x", pack, repack)
+    }
+}
+
 func Test_rr_read(t *testing.T) {
     recordString := "thunics.org. # domain\n" +
         "@       A       600  10.137.1.1\n" +
         "db3     CNAME   600  srv3.thunics.org\n" +
-        "srv3    A       600  10.137.2.3"
+        "srv3    A       600  10.137.2.3\n" +
+        "@       TYPE257 600  \\# 3 000100 # CAA\n"
 
     db, err := readRecords(strings.NewReader(recordString))
 
     for k, domain := range db.domains {
         fmt.Println(k)
-        for r, rr := range domain.records {
-            fmt.Printf("%s: %s\n", r, rr.String())
+        for r, set := range domain.records {
+            for _, rr := range set.rrs {
+                fmt.Printf("%s: %s\n", r, rr.String())
+            }
         }
     }
 
+    if _, found := db.domains["thunics.org."].records[rkeyGen("@", 257)]; !found {
+        t.Error("generic record not read")
+    }
+
     fmt.Println(matchQuery("db3.thunics.org.", db))
     fmt.Println(matchQuery("thunics.org.", db))
 
@@ -58,3 +153,136 @@ func Test_rr_read(t *testing.T) {
     }
 
 }
+
+func Test_rr_read_txt(t *testing.T) {
+    recordString := "thunics.org. # domain\n" +
+        "@       TXT     600  v=spf1 mx -all\n" +
+        "multi   TXT     600  \"hello world\" \"say \\\"hi\\\"\"\n"
+
+    db, err := readRecords(strings.NewReader(recordString))
+    if err != nil {
+        t.Fatal("error reading record file:", err)
+    }
+
+    cases := []struct {
+        name string
+        txt  []string
+    }{
+        {"thunics.org.", []string{"v=spf1 mx -all"}},
+        {"multi.thunics.org.", []string{"hello world", `say "hi"`}},
+    }
+    for _, c := range cases {
+        ans := make([]dnsRR, 0, 1)
+        queryDB(c.name, dnsTypeTXT, db, &ans)
+        if len(ans) != 1 {
+            t.Fatalf("%s: %d records", c.name, len(ans))
+        }
+        if txt := ans[0].Rdata().([]string); !reflect.DeepEqual(txt, c.txt) {
+            t.Errorf("%s: TXT %q, expected %q", c.name, txt, c.txt)
+        }
+    }
+}
+
+func Test_rr_read_bad_line(t *testing.T) {
+    recordString := "www     A       600  10.137.1.9\n" +
+        "thunics.org. # domain\n" +
+        "@       A       600  10.137.1.1\n" +
+        "db3     A       600  10.137.2.3 10.137.2.4 # extra tokens\n" +
+        "db4     A       ten  10.137.2.4\n" +
+        "db5     BOGUS   600  10.137.2.5\n" +
+        "srv3    A       600  10.137.2.3"
+
+    db, err := readRecords(strings.NewReader(recordString))
+    if err != nil {
+        t.Fatal("error reading record file:", err)
+    }
+
+    for _, name := range []string{"thunics.org.", "srv3.thunics.org."} {
+        ans := make([]dnsRR, 0, 1)
+        if result, _ := queryDB(name, dnsTypeA, db, &ans); result != querySuccess || len(ans) != 1 {
+            t.Errorf("%s: %d records", name, len(ans))
+        }
+    }
+    for _, name := range []string{"db3.thunics.org.", "db4.thunics.org.", "db5.thunics.org."} {
+        ans := make([]dnsRR, 0, 1)
+        if queryDB(name, dnsTypeA, db, &ans); len(ans) != 0 {
+            t.Errorf("%s: bad line read as %v", name, ans)
+        }
+    }
+}
+
+func Test_rr_set(t *testing.T) {
+    recordString := "thunics.org. # domain\n" +
+        "www     A       600  10.137.1.1\n" +
+        "www     A       600  10.137.1.2\n" +
+        "www     A       600  10.137.1.3\n" +
+        "*       A       600  10.137.2.1\n" +
+        "*       A       600  10.137.2.2"
+
+    db, err := readRecords(strings.NewReader(recordString))
+    if err != nil {
+        t.Fatal("error reading record file:", err)
+    }
+    db.order = RRSET_ROUND_ROBIN
+
+    firsts := map[interface{}]bool{}
+    for i := 0; i < 3; i++ {
+        ans := make([]dnsRR, 0, 3)
+        queryDB("www.thunics.org.", dnsTypeA, db, &ans)
+        if len(ans) != 3 {
+            t.Fatalf("expected 3 records, got %d", len(ans))
+        }
+        firsts[ans[0].Rdata()] = true
+    }
+    if len(firsts) != 3 {
+        t.Error("round robin did not rotate the RRset")
+    }
+
+    ans := make([]dnsRR, 0, 2)
+    queryDB("foo.thunics.org.", dnsTypeA, db, &ans)
+    if len(ans) != 2 || ans[0].Header().Name != "foo.thunics.org." {
+        t.Error("bad wildcard answer:", ans)
+    }
+    ans = ans[:0]
+    queryDB("bar.thunics.org.", dnsTypeA, db, &ans)
+    if len(ans) != 2 || ans[0].Header().Name != "bar.thunics.org." {
+        t.Error("bad wildcard answer:", ans)
+    }
+}
+
+func Test_edns0_truncate(t *testing.T) {
+    msg := new(dnsMsg)
+    msg.id = 1234
+    msg.response = true
+    msg.question = []dnsQuestion{{"many.example.com.", dnsTypeA, dnsClassINET}}
+    for i := 0; i < 64; i++ {
+        rr, _ := newRR("many.example.com.", dnsTypeA, 600, fmt.Sprintf("10.0.0.%d", i))
+        msg.answer = append(msg.answer, rr)
+    }
+    opt := newOPT(4096, true)
+    opt.Options = []dnsEDNS0Option{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}}
+    msg.setOPT(opt)
+
+    pack, err := msg.PackTruncated(dnsMinUDPSize)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(pack) > dnsMinUDPSize {
+        t.Errorf("packed %d bytes, more than %d", len(pack), dnsMinUDPSize)
+    }
+
+    reply := new(dnsMsg)
+    if _, err := reply.Unpack(pack, 0); err != nil {
+        t.Fatal(err)
+    }
+    if !reply.truncated || len(reply.answer) == 0 || len(reply.answer) == 64 {
+        t.Errorf("bad truncation: TC %t, %d answers", reply.truncated, len(reply.answer))
+    }
+    ropt := reply.opt()
+    if ropt == nil {
+        t.Fatal("OPT lost")
+    }
+    if ropt.UDPSize() != 4096 || !ropt.Do() || len(ropt.Options) != 1 || ropt.Options[0].Code != 10 {
+        t.Error("OPT mangled:", ropt.String())
+    }
+}
@@ -23,6 +23,9 @@ type dnsHeader struct {
 }
 
 func (self *dnsHeader) Unpack(msg []byte, off int) (next int, err error) {
+	if off+12 > len(msg) {
+		return len(msg), errors.New("Message too short")
+	}
 	buf := bytes.NewBuffer(msg[off : off+12])
 	err = binary.Read(buf, binary.BigEndian, self)
 	if err != nil {
@@ -46,15 +49,18 @@ type dnsMsgHeader struct {
 	truncated           bool
 	recursion_desired   bool
 	recursion_available bool
+	authentic_data      bool
+	checking_disabled   bool
 	rcode               int
 }
 
 func (self *dnsMsgHeader) String() string {
 	return fmt.Sprintf(
 		"{id: %d, response: %t, opcode: %d, authoritative: %t, "+
-			"truncated: %t, RD: %t, RA: %t, rcode: %d}",
+			"truncated: %t, RD: %t, RA: %t, AD: %t, CD: %t, rcode: %d}",
 		self.id, self.response, self.opcode, self.authoritative, self.truncated,
-		self.recursion_desired, self.recursion_available, self.rcode)
+		self.recursion_desired, self.recursion_available,
+		self.authentic_data, self.checking_disabled, self.rcode)
 }
 
 type dnsMsg struct {
@@ -70,9 +76,7 @@ func (self *dnsMsg) Pack() ([]byte, error) {
 	var buf, body bytes.Buffer
 	var dh dnsHeader
 
-	if self.names == nil {
-		self.names = make(map[string]int)
-	}
+	self.names = make(map[string]int)
 
 	nans, nns, nex := 0, 0, 0
 	off := 12
@@ -128,6 +132,12 @@ func (self *dnsMsg) Pack() ([]byte, error) {
 	if self.recursion_desired {
 		dh.Bits |= _RD
 	}
+	if self.authentic_data {
+		dh.Bits |= _AD
+	}
+	if self.checking_disabled {
+		dh.Bits |= _CD
+	}
 	if self.truncated {
 		dh.Bits |= _TC
 	}
@@ -164,6 +174,8 @@ func (self *dnsMsg) Unpack(msg []byte, off int) (next int, err error) {
 	self.truncated = (dh.Bits & _TC) != 0
 	self.recursion_desired = (dh.Bits & _RD) != 0
 	self.recursion_available = (dh.Bits & _RA) != 0
+	self.authentic_data = (dh.Bits & _AD) != 0
+	self.checking_disabled = (dh.Bits & _CD) != 0
 	self.rcode = int(dh.Bits & 0xF)
 
 	self.question = make([]dnsQuestion, dh.Qdcount)
@@ -218,18 +230,76 @@ func (self *dnsMsg) Reply() (*dnsMsg, error) {
 	rep.rcode = self.rcode
 	rep.recursion_available = true
 	rep.recursion_desired = self.recursion_desired
+	rep.checking_disabled = self.checking_disabled
 	rep.response = true
 	rep.truncated = false
 
 	rep.question = self.question
 
-	self.answer = make([]dnsRR, 0, 1)
-	self.ns = make([]dnsRR, 0, 0)
-	self.extra = make([]dnsRR, 0, 0)
+	rep.answer = make([]dnsRR, 0, 1)
+	rep.ns = make([]dnsRR, 0, 0)
+	rep.extra = make([]dnsRR, 0, 0)
 
 	return rep, nil
 }
 
+// the EDNS0 OPT pseudo RR in additional section, nil if there is none
+func (self *dnsMsg) opt() *dnsRR_OPT {
+	for _, e := range self.extra {
+		if opt, ok := e.(*dnsRR_OPT); ok {
+			return opt
+		}
+	}
+	return nil
+}
+
+// replace the OPT RR with opt, or remove it if opt is nil. The extra
+// slice is copied so messages sharing it are not affected.
+func (self *dnsMsg) setOPT(opt *dnsRR_OPT) {
+	extra := make([]dnsRR, 0, len(self.extra)+1)
+	for _, e := range self.extra {
+		if _, ok := e.(*dnsRR_OPT); !ok {
+			extra = append(extra, e)
+		}
+	}
+	if opt != nil {
+		extra = append(extra, opt)
+	}
+	self.extra = extra
+}
+
+// Pack the message into at most size bytes, dropping records from the
+// end of each section and setting the TC bit when it does not fit.
+func (self *dnsMsg) PackTruncated(size int) ([]byte, error) {
+	pack, err := self.Pack()
+	if err != nil || len(pack) <= size {
+		return pack, err
+	}
+
+	self.truncated = true
+
+	// additional records go first, except the OPT
+	opt := self.opt()
+	self.extra = make([]dnsRR, 0, 1)
+	if opt != nil {
+		self.extra = append(self.extra, opt)
+	}
+
+	for _, sec := range []*[]dnsRR{&self.ns, &self.answer} {
+		for {
+			if pack, err = self.Pack(); err != nil || len(pack) <= size {
+				return pack, err
+			}
+			if len(*sec) == 0 {
+				break
+			}
+			*sec = (*sec)[:len(*sec)-1]
+		}
+	}
+
+	return pack, nil
+}
+
 func (self *dnsMsg) String() string {
 	s := "DNS: \n"
 	s += "Header: "
@@ -257,6 +327,61 @@ func (self *dnsMsg) String() string {
 	return s
 }
 
+// offsets of the TTL field of every RR in a packed message, OPT
+// excluded since its TTL holds flags
+func ttlOffsets(msg []byte) ([]int, error) {
+	var dh dnsHeader
+	if len(msg) < 12 {
+		return nil, offsetError
+	}
+	off, err := dh.Unpack(msg, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint16(0); i < dh.Qdcount; i++ {
+		if _, off, err = unpackName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+
+	nrr := int(dh.Ancount) + int(dh.Nscount) + int(dh.Arcount)
+	offs := make([]int, 0, nrr)
+	for i := 0; i < nrr; i++ {
+		if _, off, err = unpackName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, offsetError
+		}
+		if binary.BigEndian.Uint16(msg[off:]) != dnsTypeOPT {
+			offs = append(offs, off+4)
+		}
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	}
+	if off > len(msg) {
+		return nil, offsetError
+	}
+	return offs, nil
+}
+
+// the smallest TTL of all RRs in the message, -1 if there are none
+func (self *dnsMsg) minTTL() int {
+	ttl := -1
+	for _, sec := range [][]dnsRR{self.answer, self.ns, self.extra} {
+		for _, rr := range sec {
+			if rr.Header().Rrtype == dnsTypeOPT {
+				continue
+			}
+			if t := int(rr.Header().Ttl); ttl < 0 || t < ttl {
+				ttl = t
+			}
+		}
+	}
+	return ttl
+}
+
 // DNS queries.
 type dnsQuestion struct {
 	Name   string `net:"domain-name"` // `net:"domain-name"` specifies encoding; see packers below
@@ -351,6 +476,12 @@ Loop:
 func packName(name string, names map[string]int, off int) []byte {
 	buf := bytes.NewBuffer([]byte{})
 
+	// root, never worth a pointer
+	if name == "" || name == "." {
+		buf.WriteByte(0)
+		return buf.Bytes()
+	}
+
 	offset, found := names[name]
 
 	if found {
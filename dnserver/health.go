@@ -0,0 +1,117 @@
+package toydns
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// the longest back-off between probes of a down upstream, as a
+// multiple of health_backoff
+const maxHealthBackoff = 8
+
+// circuit breaker state of an upstream
+type upstreamHealth struct {
+	lock     sync.Mutex
+	failures int // in a row
+	down     bool
+}
+
+func (self *upstreamEntry) healthy() bool {
+	self.health.lock.Lock()
+	defer self.health.lock.Unlock()
+	return !self.health.down
+}
+
+// the upstream entry of addr from the records file, shared by all
+// queries so its health is kept
+func (self *DNSServer) upstreamByAddr(addr string) *upstreamEntry {
+	self.upstreamLock.Lock()
+	defer self.upstreamLock.Unlock()
+
+	if self.upstreamReg == nil {
+		self.upstreamReg = make(map[string]*upstreamEntry)
+	}
+	e, found := self.upstreamReg[addr]
+	if !found {
+		e = newUpstreamEntry(addr)
+		self.upstreamReg[addr] = e
+	}
+	return e
+}
+
+// healthy upstreams in order, or all of them if none is
+func healthyUpstreams(upstreamEntries []*upstreamEntry) []*upstreamEntry {
+	healthy := make([]*upstreamEntry, 0, len(upstreamEntries))
+	for _, e := range upstreamEntries {
+		if e.healthy() {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		return upstreamEntries
+	}
+	return healthy
+}
+
+// count a query result against an upstream, marking it down after
+// health_failures failures in a row
+func (self *DNSServer) reportUpstream(e *upstreamEntry, err error) {
+	if self.cfg.HealthFailures <= 0 {
+		return
+	}
+	e.health.lock.Lock()
+	defer e.health.lock.Unlock()
+
+	if err == nil {
+		e.health.failures = 0
+		if e.health.down {
+			e.health.down = false
+			logger.Notice("Upstream %s is up", e.addr)
+		}
+		return
+	}
+
+	e.health.failures++
+	if !e.health.down && e.health.failures >= self.cfg.HealthFailures {
+		e.health.down = true
+		logger.Warning("Upstream %s is down after %d failures: %s",
+			e.addr, e.health.failures, err.Error())
+		go self.probeUpstream(e)
+	}
+}
+
+// ask a down upstream the canary question with growing back-off
+// until it answers
+func (self *DNSServer) probeUpstream(e *upstreamEntry) {
+	backoff := time.Duration(self.cfg.HealthBackoff) * time.Second
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-self.done:
+			return
+		}
+		if e.healthy() {
+			// brought back by a query meanwhile
+			return
+		}
+
+		probe := new(dnsMsg)
+		probe.id = uint16(rand.Intn(0x10000))
+		probe.recursion_desired = true
+		probe.question = []dnsQuestion{{self.cfg.HealthProbe, dnsTypeNS, dnsClassINET}}
+		_, dnsmsg, err := self.exchangeUpstream(e, *probe)
+		if err == nil {
+			err = replyError(dnsmsg)
+		}
+		if err == nil {
+			self.reportUpstream(e, nil)
+			return
+		}
+		logger.Debug("Probe of upstream %s failed: %s", e.addr, err.Error())
+
+		if backoff < time.Duration(self.cfg.HealthBackoff*maxHealthBackoff)*time.Second {
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package toydns
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// UDP sockets kept open to an upstream, queries are spread over them
+const upstreamPoolSize = 16
+
+// queries a socket carries before it is replaced by one on a new
+// random source port, few so that a spoofer has the port to guess
+// as well as the ID
+const maxSocketQueries = 32
+
+// replies queued for a query not yet read
+const pendingReplies = 4
+
+var errPoolClosed = errors.New("Upstream pool closed")
+
+// a read deadline passed, a net.Error like those of sockets
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// one side of a query to an upstream
+type upstreamExchange interface {
+	send(msg []byte) error
+	// the next good reply before deadline
+	recv(deadline time.Time) ([]byte, *dnsMsg, error)
+	Close() error
+}
+
+// a query on a connection of its own, TCP
+type connExchange struct {
+	conn  dnsConn
+	query *dnsMsg
+	seen  map[string]bool
+}
+
+func (self *connExchange) send(msg []byte) error {
+	return self.conn.Write(msg)
+}
+
+func (self *connExchange) recv(deadline time.Time) ([]byte, *dnsMsg, error) {
+	self.conn.SetReadDeadline(deadline)
+	for {
+		upMsg, err := self.conn.Read()
+		if err != nil {
+			return nil, nil, err
+		}
+		if dnsmsg, ok := checkReply(upMsg, self.query, self.seen); ok {
+			return upMsg, dnsmsg, nil
+		}
+	}
+}
+
+func (self *connExchange) Close() error {
+	return self.conn.Close()
+}
+
+// a UDP socket shared by queries to an upstream, telling their
+// replies apart by ID
+type upstreamSocket struct {
+	conn    dnsConn
+	lock    sync.Mutex
+	pending map[uint16]chan []byte // by ID on the wire
+	queries int                    // sent on it
+	retired bool                   // closed once nothing is pending
+	closed  bool
+}
+
+func (self *upstreamSocket) readLoop() {
+	for {
+		upMsg, err := self.conn.Read()
+		if err != nil {
+			self.lock.Lock()
+			closed := self.closed
+			self.lock.Unlock()
+			if closed {
+				return
+			}
+			// refused or undecryptable
+			logger.Debug("Reading from %v: %s", self.conn, err.Error())
+			continue
+		}
+		if len(upMsg) < 12 {
+			continue
+		}
+		id := uint16(upMsg[0])<<8 + uint16(upMsg[1])
+		self.lock.Lock()
+		replies, found := self.pending[id]
+		self.lock.Unlock()
+		if !found {
+			logger.Debug("Reply %d from %v to no query", id, self.conn)
+			continue
+		}
+		select {
+		case replies <- upMsg:
+		default:
+			// flooded, the query has enough to choose from
+		}
+	}
+}
+
+// a query ID from crypto/rand, not to be told from the IDs seen before
+func randomID() uint16 {
+	var b [2]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		logger.Error("Reading random ID: %s", err.Error())
+		return uint16(rand.Intn(0x10000))
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// take a random free ID for a query, false if the socket is full
+func (self *upstreamSocket) register() (uint16, chan []byte, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.retired || len(self.pending) >= 0x8000 {
+		return 0, nil, false
+	}
+	// drawn again when taken, a neighbour of it would be easy to guess
+	var id uint16
+	for {
+		id = randomID()
+		if _, used := self.pending[id]; !used {
+			break
+		}
+	}
+	replies := make(chan []byte, pendingReplies)
+	self.pending[id] = replies
+	self.queries++
+	if self.queries >= maxSocketQueries {
+		self.retired = true
+	}
+	return id, replies, true
+}
+
+func (self *upstreamSocket) unregister(id uint16) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	delete(self.pending, id)
+	self.closeIdle()
+}
+
+// close now if idle, or after the last query
+func (self *upstreamSocket) retire() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.retired = true
+	self.closeIdle()
+}
+
+// with lock held
+func (self *upstreamSocket) closeIdle() {
+	if self.retired && !self.closed && len(self.pending) == 0 {
+		self.closed = true
+		self.conn.Close()
+	}
+}
+
+// UDP sockets of an upstream
+type upstreamPool struct {
+	entry   *upstreamEntry
+	bufSize int
+	lock    sync.Mutex
+	sockets [upstreamPoolSize]*upstreamSocket
+	next    int
+	closed  bool
+}
+
+func newUpstreamPool(entry *upstreamEntry, bufSize int) *upstreamPool {
+	return &upstreamPool{entry: entry, bufSize: bufSize}
+}
+
+// a query on one of the sockets, dialing it if needed
+func (self *upstreamPool) exchange(query *dnsMsg) (upstreamExchange, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return nil, errPoolClosed
+	}
+	i := self.next
+	self.next = (self.next + 1) % upstreamPoolSize
+
+	if sock := self.sockets[i]; sock != nil {
+		if id, replies, ok := sock.register(); ok {
+			return &pooledExchange{sock, id, query, replies, make(map[string]bool)}, nil
+		}
+		// out of IDs, closed after its last query like a retired one
+		sock.retire()
+	}
+
+	conn, err := dialUpstream(self.entry, self.bufSize)
+	if err != nil {
+		return nil, err
+	}
+	sock := &upstreamSocket{conn: conn, pending: make(map[uint16]chan []byte)}
+	go sock.readLoop()
+	self.sockets[i] = sock
+	id, replies, _ := sock.register()
+	return &pooledExchange{sock, id, query, replies, make(map[string]bool)}, nil
+}
+
+func (self *upstreamPool) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.closed = true
+	for i, sock := range self.sockets {
+		if sock != nil {
+			sock.retire()
+			self.sockets[i] = nil
+		}
+	}
+	return nil
+}
+
+// a query on a pooled socket, sent under a random ID and answered
+// with the one of the client
+type pooledExchange struct {
+	sock    *upstreamSocket
+	id      uint16
+	query   *dnsMsg
+	replies chan []byte
+	seen    map[string]bool
+}
+
+func (self *pooledExchange) send(msg []byte) error {
+	wire := make([]byte, len(msg))
+	copy(wire, msg)
+	wire[0], wire[1] = byte(self.id>>8), byte(self.id)
+	return self.sock.conn.Write(wire)
+}
+
+func (self *pooledExchange) recv(deadline time.Time) ([]byte, *dnsMsg, error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case upMsg := <-self.replies:
+			upMsg[0], upMsg[1] = byte(self.query.id>>8), byte(self.query.id)
+			if dnsmsg, ok := checkReply(upMsg, self.query, self.seen); ok {
+				return upMsg, dnsmsg, nil
+			}
+		case <-timer.C:
+			return nil, nil, timeoutError{}
+		}
+	}
+}
+
+func (self *pooledExchange) Close() error {
+	self.sock.unregister(self.id)
+	return nil
+}
+
+// close the sockets of all upstreams
+func (self *DNSServer) closeUpstreams() {
+	entries := []*upstreamEntry{}
+	if self.upstreams != nil {
+		entries = append(entries, self.upstreams.entries...)
+	}
+	for _, g := range self.groups {
+		entries = append(entries, g.entries...)
+	}
+	self.upstreamLock.Lock()
+	for _, e := range self.upstreamReg {
+		entries = append(entries, e)
+	}
+	self.upstreamLock.Unlock()
+
+	for _, e := range entries {
+		e.closePool()
+	}
+}
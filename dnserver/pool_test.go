@@ -0,0 +1,215 @@
+package toydns
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func Test_upstream_pool(t *testing.T) {
+	var lock sync.Mutex
+	ids := map[uint16]bool{}
+	ports := map[string]bool{}
+	addr, stop := startTestUpstream(t, func(q *dnsMsg) *dnsMsg {
+		lock.Lock()
+		ids[q.id] = true
+		lock.Unlock()
+		return answerA("10.0.0.6")(q)
+	})
+	defer stop()
+
+	srv := newTestServer(addr)
+	e := srv.upstreams.entries[0]
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := testQuery(fmt.Sprintf("pool%d.example.com.", i))
+			_, reply, err := srv.exchangeUpstream(e, *q)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if reply.id != q.id || reply.question[0].Name != q.question[0].Name {
+				t.Errorf("reply %d to %s for %d %s", reply.id, reply.question[0].Name,
+					q.id, q.question[0].Name)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// all of them asked as 4321, sent under IDs of their own
+	lock.Lock()
+	defer lock.Unlock()
+	if len(ids) < 40 {
+		t.Errorf("%d IDs on the wire", len(ids))
+	}
+	for _, sock := range e.pool.sockets {
+		if sock != nil {
+			ports[sock.conn.(*udpDNSConn).udpConn.LocalAddr().String()] = true
+			if len(sock.pending) != 0 {
+				t.Errorf("%d queries left pending", len(sock.pending))
+			}
+		}
+	}
+	if len(ports) == 0 || len(ports) > upstreamPoolSize {
+		t.Errorf("%d sockets", len(ports))
+	}
+
+	srv.closeUpstreams()
+	for _, sock := range e.pool.sockets {
+		if sock != nil {
+			t.Error("socket kept after close")
+		}
+	}
+	if _, _, err := srv.exchangeUpstream(e, *testQuery("closed.example.com.")); err != errPoolClosed {
+		t.Errorf("query on a closed pool: %v", err)
+	}
+}
+
+func Test_upstream_socket_retire(t *testing.T) {
+	addr, stop := startTestUpstream(t, answerA("10.0.0.7"))
+	defer stop()
+
+	srv := newTestServer(addr)
+	e := srv.upstreams.entries[0]
+	if _, _, err := srv.exchangeUpstream(e, *testQuery("first.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	sock := e.pool.sockets[0]
+	sock.queries = maxSocketQueries - 1
+	e.pool.next = 0
+	if _, _, err := srv.exchangeUpstream(e, *testQuery("last.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	if !sock.closed {
+		t.Error("socket open after its last query")
+	}
+
+	// a new one in its place
+	e.pool.next = 0
+	if _, _, err := srv.exchangeUpstream(e, *testQuery("next.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	if e.pool.sockets[0] == sock {
+		t.Error("retired socket reused")
+	}
+}
+
+func Test_upstream_wrong_question(t *testing.T) {
+	// a spoofed reply ahead of the real one
+	conn, err := listenUDPDNS("127.0.0.1:0", dnsDefaultEDNSSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for {
+			q, clientAddr, err := conn.ReadPacketFrom()
+			if err != nil {
+				return
+			}
+			spoofed := answerA("6.6.6.6")(q)
+			spoofed.question = []dnsQuestion{q.question[0]}
+			spoofed.question[0].Name = "other.example.com."
+			conn.WritePacketTo(spoofed, clientAddr)
+			conn.WritePacketTo(answerA("10.0.0.8")(q), clientAddr)
+		}
+	}()
+
+	srv := newTestServer(conn.udpConn.LocalAddr().String())
+	pack, err := srv.questionUpstream(srv.upstreams.entries[0], *testQuery("asked.example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := new(dnsMsg)
+	reply.Unpack(pack, 0)
+	if reply.question[0].Name != "asked.example.com." || len(reply.answer) != 1 {
+		t.Errorf("took %s", reply.String())
+	}
+	if _, found := srv.cache.Get(testQuestion("other.example.com.", dnsTypeA)); found {
+		t.Error("spoofed reply cached")
+	}
+}
+
+func Test_check_reply(t *testing.T) {
+	query := testQuery("www.Example.com.")
+	cases := []struct {
+		desc  string
+		tweak func(r *dnsMsg)
+		ok    bool
+	}{
+		{"as asked", func(r *dnsMsg) {}, true},
+		{"name case", func(r *dnsMsg) { r.question[0].Name = "WWW.example.COM." }, true},
+		{"no QR", func(r *dnsMsg) { r.response = false }, false},
+		{"opcode", func(r *dnsMsg) { r.opcode = 5 }, false},
+		{"name", func(r *dnsMsg) { r.question[0].Name = "www.example.org." }, false},
+		{"type", func(r *dnsMsg) { r.question[0].Qtype = dnsTypeAAAA }, false},
+		{"class", func(r *dnsMsg) { r.question[0].Qclass = dnsClassCHAOS }, false},
+		{"no question", func(r *dnsMsg) { r.question = nil }, false},
+		{"two questions", func(r *dnsMsg) { r.question = append(r.question, r.question[0]) }, false},
+		{"id", func(r *dnsMsg) { r.id++ }, false},
+	}
+	for _, c := range cases {
+		reply := answerA("10.0.0.9")(query)
+		reply.question = []dnsQuestion{query.question[0]}
+		c.tweak(reply)
+		pack, err := reply.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := checkReply(pack, query, make(map[string]bool)); ok != c.ok {
+			t.Errorf("%s: ok %t", c.desc, ok)
+		}
+	}
+
+	// a copy of a reply seen
+	seen := make(map[string]bool)
+	pack, _ := answerA("10.0.0.9")(query).Pack()
+	if _, ok := checkReply(pack, query, seen); !ok {
+		t.Error("reply not taken")
+	}
+	if _, ok := checkReply(pack, query, seen); ok {
+		t.Error("copy taken")
+	}
+}
+
+func Test_upstream_socket_full(t *testing.T) {
+	addr, stop := startTestUpstream(t, answerA("10.0.0.11"))
+	defer stop()
+
+	srv := newTestServer(addr)
+	e := srv.upstreams.entries[0]
+	if _, _, err := srv.exchangeUpstream(e, *testQuery("first.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	sock := e.pool.sockets[0]
+	// every ID taken by queries in flight, before it is due to retire
+	sock.queries = -0x10000
+	ids := []uint16{}
+	for len(sock.pending) < 0x8000 {
+		id, _, ok := sock.register()
+		if !ok {
+			t.Fatal("socket full early")
+		}
+		ids = append(ids, id)
+	}
+
+	e.pool.next = 0
+	if _, _, err := srv.exchangeUpstream(e, *testQuery("next.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	if e.pool.sockets[0] == sock {
+		t.Fatal("full socket kept")
+	}
+	if !sock.retired || sock.closed {
+		t.Error("full socket not retired, or closed under its queries")
+	}
+	for _, id := range ids {
+		sock.unregister(id)
+	}
+	if !sock.closed {
+		t.Error("full socket left open")
+	}
+}
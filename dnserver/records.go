@@ -3,25 +3,113 @@ package toydns
 import (
 	"bufio"
 	"errors"
-	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
+// all records of the same name and type
+type rrSet struct {
+	rrs  []dnsRR
+	next uint32 // round robin position
+}
+
+// a copy of the records in the given order
+func (self *rrSet) ordered(order string) []dnsRR {
+	n := len(self.rrs)
+	rrs := make([]dnsRR, n)
+	switch order {
+	case RRSET_ROUND_ROBIN:
+		start := int(atomic.AddUint32(&self.next, 1) % uint32(n))
+		for i := range rrs {
+			rrs[i] = self.rrs[(start+i)%n]
+		}
+	case RRSET_RANDOM:
+		for i, j := range rand.Perm(n) {
+			rrs[i] = self.rrs[j]
+		}
+	default:
+		copy(rrs, self.rrs)
+	}
+	return rrs
+}
+
 // a domain and records
 type domain struct {
 	name    string
-	records map[string]dnsRR
+	records map[string]*rrSet
+	names   map[string]bool // names that exist, including empty non-terminals
+}
+
+func (self *domain) addRecord(record string, rr dnsRR) {
+	record = strings.ToLower(record)
+	rkey := rkeyGen(record, int(rr.Header().Rrtype))
+	set, found := self.records[rkey]
+	if !found {
+		set = &rrSet{rrs: make([]dnsRR, 0, 1)}
+		self.records[rkey] = set
+	}
+	set.rrs = append(set.rrs, rr)
+
+	for r := record; r != "@"; {
+		self.names[r] = true
+		i := strings.Index(r, ".")
+		if i < 0 {
+			break
+		}
+		r = r[i+1:]
+	}
+}
+
+// the closest existing ancestor of a missing record, "@" for the apex
+func (self *domain) closestEncloser(record string) string {
+	for r := record; r != "@"; {
+		i := strings.Index(r, ".")
+		if i < 0 {
+			break
+		}
+		r = r[i+1:]
+		if self.names[r] {
+			return r
+		}
+	}
+	return "@"
+}
+
+// the SOA for negative answers, a made up one if the zone has none.
+// TTL is the SOA minimum if smaller (RFC 2308)
+func (self *domain) negativeSOA() dnsRR {
+	var rdata interface{}
+	ttl := 60
+	if set, found := self.records[rkeyGen("@", dnsTypeSOA)]; found {
+		soa := set.rrs[0].(*dnsRR_SOA)
+		rdata = soa.Rdata()
+		ttl = int(soa.Hdr.Ttl)
+		if int(soa.Minimum) < ttl {
+			ttl = int(soa.Minimum)
+		}
+	} else {
+		rdata = []string{self.name, "hostmaster." + self.name, "1", "3600", "600", "86400", "60"}
+	}
+
+	soa, err := newRR(self.name, dnsTypeSOA, ttl, rdata)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil
+	}
+	return soa
 }
 
 // manage domains
 type domainDB struct {
 	regexs  map[string]*regexp.Regexp //match patterns
 	domains map[string]*domain
+	order   string // RRset ordering in answers
 }
 
 // upstreams for specified domain
@@ -44,17 +132,64 @@ func readRecordsFile(path string) (*domainDB, error) {
 	return readRecords(file)
 }
 
-func readRecords(rd io.Reader) (*domainDB, error) {
+func newDomainDB() *domainDB {
 	db := new(domainDB)
 	db.regexs = make(map[string]*regexp.Regexp, 1)
 	db.domains = make(map[string]*domain, 1)
+	return db
+}
+
+// get the domain named name, adding it if it is not there yet
+func (db *domainDB) addDomain(name string) (*domain, error) {
+	if d, found := db.domains[name]; found {
+		return d, nil
+	}
+
+	rx, err := regexp.Compile(`(?i)^(?:(.+)\.)?` + regexp.QuoteMeta(name) + `$`)
+	if err != nil {
+		return nil, err
+	}
+	db.regexs[name] = rx
+	d := &domain{
+		name:    name,
+		records: make(map[string]*rrSet, 4),
+		names:   make(map[string]bool, 4),
+	}
+	db.domains[name] = d
+	return d, nil
+}
+
+// read the records file and zone files in config into one db
+func readDomainDB(cfg *srvConfig) (*domainDB, error) {
+	var err error
+	db := newDomainDB()
+	if cfg.RecordFile != "" {
+		if db, err = readRecordsFile(cfg.RecordFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, z := range cfg.Zones {
+		if err = readZoneFile(db, z.File, z.Origin); err != nil {
+			return nil, err
+		}
+	}
+
+	db.order = cfg.RRSetOrder
+	return db, nil
+}
+
+func readRecords(rd io.Reader) (*domainDB, error) {
+	db := newDomainDB()
 	var curDomain string
 
 	br := bufio.NewReader(rd)
 	upstreamTree = newSuffixTree("", nil)
 
+	lineno := 0
 	for {
 		line, isPrefix, err1 := br.ReadLine()
+		lineno++
 
 		if err1 != nil {
 			if err1 != io.EOF {
@@ -69,7 +204,14 @@ func readRecords(rd io.Reader) (*domainDB, error) {
 
 		str_line := string(line)
 
-		strs := strings.Split(str_line, "#")[0]
+		// '#' starts a comment, except in the \# of RFC 3597 rdata
+		strs := str_line
+		for i := 0; i < len(strs); i++ {
+			if strs[i] == '#' && (i == 0 || strs[i-1] != '\\') {
+				strs = strs[:i]
+				break
+			}
+		}
 
 		if len(strs) == 0 {
 			continue
@@ -87,29 +229,31 @@ func readRecords(rd io.Reader) (*domainDB, error) {
 
 		//fmt.Println(tokens, len(tokens))
 
-		switch len(tokens) {
+		ntokens := len(tokens)
+		if ntokens > 4 {
+			// rdata of MX, SRV, SOA and TXT spans several tokens
+			ntokens = 4
+		}
+
+		switch ntokens {
 
 		// len 1 is domain name
 		case 1:
 			//logger.Debug("1: %v", tokens)
 			curDomain = tokens[0]
-
-			rdomain := strings.Replace(curDomain, `.`, `\.`, -1)
-			rx, err := regexp.Compile(`^([-A-Za-z0-9.]*)\.?` + rdomain + `$`)
-
-			if err != nil {
+			if _, err := db.addDomain(curDomain); err != nil {
 				return nil, err
 			}
-			db.regexs[curDomain] = rx
-			domain := &domain{name: curDomain, records: make(map[string]dnsRR, 4)}
-			db.domains[curDomain] = domain
 
-		// len 4 is record
+		// len 4 is record, a bad one is skipped and the rest still served
 		case 4:
 			//logger.Debug("4: %v", tokens)
+			if _, found := db.domains[curDomain]; !found {
+				logger.Warning("Records line %d: no domain before it, skipped", lineno)
+				continue
+			}
 			var name string
-			var rrtype int
-			record, srtype, sttl, rdata := tokens[0], tokens[1], tokens[2], tokens[3]
+			record, srtype, sttl, fields := tokens[0], tokens[1], tokens[2], tokens[3:]
 			var wildcard = false
 
 			switch record {
@@ -127,47 +271,54 @@ func readRecords(rd io.Reader) (*domainDB, error) {
 				name += curDomain
 			}
 
-			switch srtype {
-			case "A":
-				rrtype = dnsTypeA
-			case "AAAA":
-				rrtype = dnsTypeAAAA
-			case "CNAME":
-				rrtype = dnsTypeCNAME
-				if !strings.HasSuffix(rdata, ".") {
-					rdata += "."
-				}
+			t, _ := dnsTypeFromString(srtype)
+			rrtype := int(t)
+			switch rrtype {
+			case dnsTypeA, dnsTypeAAAA, dnsTypeCNAME, dnsTypeNS,
+				dnsTypeMX, dnsTypeTXT, dnsTypeSRV, dnsTypePTR, dnsTypeSOA:
 			default:
-				return nil, fmt.Errorf("unsported record type: %s", srtype)
+				// other types only in RFC 3597 form
+				if rrtype == 0 || rrtype == dnsTypeOPT || fields[0] != `\#` {
+					logger.Warning("Records line %d: unsupported record type %s, skipped", lineno, srtype)
+					continue
+				}
 			}
 
+			rdata := recordRdata(rrtype, fields)
+
 			ttl, err := strconv.Atoi(sttl)
 			if err != nil {
-				return nil, err
+				logger.Warning("Records line %d: bad TTL %s, skipped", lineno, sttl)
+				continue
 			}
 
 			rr, err := newRR(name, rrtype, ttl, rdata)
 			//logger.Debug("%s %v", name, rr.Header().Rdlength)
 			if err != nil {
-				return nil, err
+				logger.Warning("Records line %d: %s, skipped", lineno, err.Error())
+				continue
 			}
 
-			rkey := record + ":" + strconv.Itoa(rrtype)
-			db.domains[curDomain].records[rkey] = rr
+			db.domains[curDomain].addRecord(record, rr)
 
 		case 2:
 			// upstream
 			//logger.Debug("2: %v", tokens)
 			domain, upaddr := tokens[0], tokens[1]
 
-			if _, err := net.ResolveUDPAddr("udp", upaddr); err == nil {
-				upaddr = upaddr
-			} else if _ip := net.ParseIP(upaddr); _ip != nil {
-				upaddr = upaddr + ":53"
-			} else {
+			// an upstream group
+			if strings.HasPrefix(upaddr, "@") {
+				upstreamTree.sinsert(strings.Split(domain, "."), upaddr)
 				continue
 			}
 
+			if _, err := net.ResolveUDPAddr("udp", upaddr); err != nil {
+				if _ip := net.ParseIP(upaddr); _ip == nil {
+					continue
+				}
+				upaddr = upaddr + ":53"
+			}
+
 			upstreamTree.sinsert(strings.Split(domain, "."), upaddr)
 
 		default:
@@ -179,71 +330,189 @@ func readRecords(rd io.Reader) (*domainDB, error) {
 	return db, nil
 }
 
+// find the domain qname is in, the deepest one if domains are nested
 func matchQuery(qname string, db *domainDB) (dkey string, record string, match bool) {
 
-	for dkey, drgx := range db.regexs {
+	for key, drgx := range db.regexs {
 
 		//logger.Debug(dkey)
 		matches := drgx.FindStringSubmatch(qname)
-		switch len(matches) {
-		case 2:
-			record := matches[1]
-			if len(record) == 0 {
-				record = "@"
-			} else {
-				record = record[:len(record)-1]
-			}
-			return dkey, record, true
-		default:
+		if len(matches) != 2 || (match && len(key) <= len(dkey)) {
 			continue
 		}
+
+		dkey, record, match = key, strings.ToLower(matches[1]), true
+		if len(record) == 0 {
+			record = "@"
+		}
 	}
 
-	return "", "", false
+	return dkey, record, match
+}
+
+// result of a local lookup
+const (
+	queryNotOwned = iota // not in any local domain
+	querySuccess
+	queryNoData   // the name exists, but has no records of the type
+	queryNXDomain // the name does not exist
+)
+
+// the longest CNAME chain followed in local domains
+const maxCNAMEChain = 8
+
+// look up qname in local domains, appending answers to ans. dkey is
+// the domain the lookup ended in, its SOA goes with negative answers.
+func queryDB(qname string, qtype int, db *domainDB, ans *[]dnsRR) (result int, dkey string) {
+	return queryDBChain(qname, qtype, db, ans, 0)
 }
 
-func queryDB(qname string, qtype int, db *domainDB, ans *[]dnsRR) (found bool) {
+func queryDBChain(qname string, qtype int, db *domainDB, ans *[]dnsRR, depth int) (result int, dkey string) {
+	dkey, record, match := matchQuery(qname, db)
+	if !match {
+		return queryNotOwned, ""
+	}
+	d := db.domains[dkey]
+
 	//non-recursive query
-	nrquery := func(dkey string, record string, qtype int) (rr dnsRR, found bool) {
-		rkey := rkeyGen(record, qtype)
-		rr, found = db.domains[dkey].records[rkey]
+	nrquery := func(record string, qtype int) (rrs []dnsRR, found bool) {
+		if qtype == dnsTypeALL {
+			prefix := record + ":"
+			for rkey, set := range d.records {
+				if strings.HasPrefix(rkey, prefix) {
+					rrs = append(rrs, set.ordered(db.order)...)
+				}
+			}
+			return rrs, len(rrs) > 0
+		}
+
+		set, found := d.records[rkeyGen(record, qtype)]
 		if !found {
-			rkey := rkeyGen("*", qtype)
-			rr, found = db.domains[dkey].records[rkey]
+			return nil, false
 		}
-		return rr, found
+		return set.ordered(db.order), true
 	}
 
-	dkey, record, match := matchQuery(qname, db)
-	if !match {
-		return false
+	// wildcard at the closest encloser when the name itself does not exist
+	exists := record == "@" || d.names[record]
+	wildcard := false
+	if !exists {
+		encloser := d.closestEncloser(record)
+		if encloser == "@" {
+			record = "*"
+		} else {
+			record = "*." + encloser
+		}
+		if !d.names[record] {
+			return queryNXDomain, dkey
+		}
+		wildcard = true
 	}
 
-	rr, found := nrquery(dkey, record, qtype)
+	// wildcard records carry the wildcard name, answer
+	// with copies so the shared records stay untouched
+	synthesize := func(rrs []dnsRR) []dnsRR {
+		if wildcard {
+			for i, rr := range rrs {
+				h := rr.Header()
+				rrs[i], _ = newRR(qname, int(h.Rrtype), int(h.Ttl), rr.Rdata())
+			}
+		}
+		return rrs
+	}
+
+	if rrs, found := nrquery(record, qtype); found {
+		*ans = append(*ans, synthesize(rrs)...)
+		return querySuccess, dkey
+	}
+
+	//if CNAME is avalible
+	_rrs, _found := nrquery(record, dnsTypeCNAME)
+	if !_found {
+		return queryNoData, dkey
+	}
+	_rr := synthesize(_rrs[:1])[0]
+	*ans = append(*ans, _rr)
+
+	cname := _rr.Rdata().(string)
+	if !strings.HasSuffix(cname, ".") {
+		cname += "."
+	}
+	if depth >= maxCNAMEChain {
+		return querySuccess, dkey
+	}
 
-	if found {
-		if rr.Header().Name == "" {
-			rr.Header().Name = qname
+	// the rest of the chain is not ours, let the client follow it
+	result, cdkey := queryDBChain(cname, qtype, db, ans, depth+1)
+	if result == queryNotOwned {
+		return querySuccess, dkey
+	}
+	return result, cdkey
+}
+
+// rdata for newRR from the fields of a record in the records file:
+// names made absolute, and TXT a single character-string unless it
+// is written as quoted ones
+func recordRdata(rrtype int, fields []string) interface{} {
+	if fields[0] == `\#` {
+		return fields
+	}
+	for _, i := range rdataNameFields[rrtype] {
+		if i < len(fields) && !strings.HasSuffix(fields[i], ".") {
+			fields[i] += "."
 		}
-		*ans = append(*ans, rr)
-	} else {
-		//if CNAME is avalible
-		_rr, _found := nrquery(dkey, record, dnsTypeCNAME)
-		if _found {
-			*ans = append(*ans, _rr)
+	}
+	if rrtype == dnsTypeTXT {
+		return txtStrings(strings.Join(fields, " "))
+	}
+	if len(fields) == 1 {
+		return fields[0]
+	}
+	return fields
+}
 
-			cname := _rr.Rdata().(string)
-			if !strings.HasSuffix(cname, ".") {
-				cname += "."
+// character-strings of TXT rdata, "" quoted ones with \ escapes if
+// there is a quote, else all of it
+func txtStrings(text string) []string {
+	if !strings.Contains(text, `"`) {
+		return []string{text}
+	}
+	strs := []string{}
+	var cur []byte
+	quoted, inString := false, false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text):
+			i++
+			cur = append(cur, text[i])
+			inString = true
+		case c == '"':
+			if quoted {
+				strs = append(strs, string(cur))
+				cur, inString = nil, false
+			}
+			quoted = !quoted
+		case c == ' ' && !quoted:
+			if inString {
+				strs = append(strs, string(cur))
+				cur, inString = nil, false
 			}
-			return queryDB(cname, qtype, db, ans)
+		default:
+			cur = append(cur, c)
+			inString = true
 		}
-		return false
 	}
-	return true
+	if inString || quoted {
+		strs = append(strs, string(cur))
+	}
+	return strs
 }
 
 func getUpstreamAddr(qname string) (string, bool) {
+	if upstreamTree == nil {
+		return "", false
+	}
 	queryKeys := strings.Split(qname, ".")
 	queryKeys = queryKeys[:len(queryKeys)-1] // ignore last '.'
 
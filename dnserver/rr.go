@@ -3,8 +3,12 @@ package toydns
 import (
     "bytes"
     "encoding/binary"
+    "encoding/hex"
+    "errors"
     "fmt"
     "net"
+    "strconv"
+    "strings"
 )
 
 var rr_mk = map[int]func() dnsRR{
@@ -13,6 +17,22 @@ var rr_mk = map[int]func() dnsRR{
     dnsTypeAAAA:  func() dnsRR { return new(dnsRR_AAAA) },
     dnsTypeNS:    func() dnsRR { return new(dnsRR_NS) },
     dnsTypeOPT:   func() dnsRR { return new(dnsRR_OPT) },
+    dnsTypeMX:    func() dnsRR { return new(dnsRR_MX) },
+    dnsTypeTXT:   func() dnsRR { return new(dnsRR_TXT) },
+    dnsTypeSRV:   func() dnsRR { return new(dnsRR_SRV) },
+    dnsTypePTR:   func() dnsRR { return new(dnsRR_PTR) },
+    dnsTypeSOA:   func() dnsRR { return new(dnsRR_SOA) },
+}
+
+// index of domain names in the presentation fields of rdata,
+// record files use it to make them absolute
+var rdataNameFields = map[int][]int{
+    dnsTypeCNAME: []int{0},
+    dnsTypeNS:    []int{0},
+    dnsTypePTR:   []int{0},
+    dnsTypeMX:    []int{1},
+    dnsTypeSRV:   []int{3},
+    dnsTypeSOA:   []int{0, 1},
 }
 
 type dnsRR interface {
@@ -106,23 +126,65 @@ func (self *dnsRR_unknown) setRdata(data interface{}) error {
     default:
         return fmt.Errorf("Unsupported type")
     }
+    self.Hdr.Rdlength = uint16(len(self.rawRdata))
     return nil
 }
 
 func (self *dnsRR_unknown) String() string {
     header := self.Hdr
-    return fmt.Sprintf("{name: %s, TTL: %d, class: %d, type: UNKNOWN, rdata: % x}",
-        header.Name, header.Ttl, header.Class, self.rawRdata)
+    return fmt.Sprintf("{name: %s, TTL: %d, class: %d, type: %s, rdata: %s}",
+        header.Name, header.Ttl, header.Class,
+        dnsTypeString(header.Rrtype), genericRdataString(self.rawRdata))
 }
 
 func (self *dnsRR_unknown) unpackRdata(msg []byte, off int) {
-    self.rawRdata = msg[off:]
+    self.rawRdata = make([]byte, len(msg)-off)
+    copy(self.rawRdata, msg[off:])
 }
 
+// RFC 3597, rdata of unknown types is passed on as it is
 func (self *dnsRR_unknown) Pack(names map[string]int, off int) ([]byte, error) {
+    self.Hdr.Rdlength = uint16(len(self.rawRdata))
     buf, _ := self.Hdr.Pack(names, off)
     buf.Write(self.rawRdata)
-    return buf.Bytes(), fmt.Errorf("unknown RR type: %d", self.Hdr.Rrtype)
+    return buf.Bytes(), nil
+}
+
+// RFC 3597 presentation of rdata: \# length hex
+func genericRdataString(raw []byte) string {
+    if len(raw) == 0 {
+        return `\# 0`
+    }
+    return fmt.Sprintf(`\# %d %x`, len(raw), raw)
+}
+
+// decode rdata in RFC 3597 presentation, ok is false if data is not in it
+func genericRdata(data interface{}) (raw []byte, ok bool, err error) {
+    var fields []string
+    switch v := data.(type) {
+    case []string:
+        fields = v
+    case string:
+        fields = strings.Fields(v)
+    default:
+        return nil, false, nil
+    }
+    if len(fields) < 2 || fields[0] != `\#` {
+        return nil, false, nil
+    }
+
+    length, err := strconv.Atoi(fields[1])
+    if err != nil {
+        return nil, true, err
+    }
+    raw, err = hex.DecodeString(strings.Join(fields[2:], ""))
+    if err != nil {
+        return nil, true, err
+    }
+    if len(raw) != length || length > 0xFFFF {
+        return nil, true, fmt.Errorf("rdata length %d does not match %d", len(raw), length)
+    }
+    return raw, true, nil
 }
 
 //A
@@ -136,6 +198,9 @@ func (self *dnsRR_A) Rdata() interface{} {
 }
 
 func (self *dnsRR_A) unpackRdata(msg []byte, off int) {
+    if off+4 > len(msg) {
+        return
+    }
     buf := bytes.NewBuffer(msg[off : off+4])
     binary.Read(buf, binary.BigEndian, &self.A)
 }
@@ -156,6 +221,9 @@ func (self *dnsRR_A) Pack(names map[string]int, off int) ([]byte, error) {
 
 func (self *dnsRR_A) setRdata(data interface{}) error {
     toInt32 := func(ip net.IP) uint32 {
+        if ip.To4() == nil {
+            return 0
+        }
         buf := bytes.NewBuffer(ip.To4()[0:4])
         uint32Ip := uint32(0)
         binary.Read(buf, binary.BigEndian, &uint32Ip)
@@ -166,7 +234,11 @@ func (self *dnsRR_A) setRdata(data interface{}) error {
     case net.IP:
         self.A = toInt32(v)
     case string:
-        self.A = toInt32(net.ParseIP(v))
+        ip := net.ParseIP(v)
+        if ip == nil || ip.To4() == nil {
+            return fmt.Errorf("bad IPv4 address: %s", v)
+        }
+        self.A = toInt32(ip)
     case uint32:
         self.A = v
     default:
@@ -186,6 +258,9 @@ func (self *dnsRR_AAAA) Rdata() interface{} {
 }
 
 func (self *dnsRR_AAAA) unpackRdata(msg []byte, off int) {
+    if off+16 > len(msg) {
+        return
+    }
     buf := bytes.NewBuffer(msg[off : off+16])
     buf.Read(self.AAAA[:])
 }
@@ -209,6 +284,9 @@ func (self *dnsRR_AAAA) setRdata(data interface{}) error {
     self.Hdr.Rdlength = uint16(16)
 
     switch v := data.(type) {
+    case [16]byte:
+        self.AAAA = v
+        return nil
     case net.IP:
         if len(v) == net.IPv6len {
             for i, x := range v {
@@ -349,28 +427,505 @@ func (self *dnsRR_NS) setRdata(data interface{}) error {
 
 }
 
-//OPT
+//OPT (RFC 6891), a pseudo RR whose header is reused: class is the
+//requestor's UDP payload size, TTL holds extended rcode, version and flags
+type dnsEDNS0Option struct {
+    Code uint16
+    Data []byte
+}
+
+// the client subnet option (RFC 7871), Address is masked to SourcePrefix
+type dnsEDNS0Subnet struct {
+    Family       uint16 // 1 for IPv4, 2 for IPv6
+    SourcePrefix int
+    ScopePrefix  int
+    Address      net.IP
+}
+
+func (self *dnsEDNS0Option) subnet() (*dnsEDNS0Subnet, error) {
+    if self.Code != dnsOptionSubnet || len(self.Data) < 4 {
+        return nil, errors.New("not a client subnet option")
+    }
+    ecs := new(dnsEDNS0Subnet)
+    ecs.Family = binary.BigEndian.Uint16(self.Data)
+    ecs.SourcePrefix = int(self.Data[2])
+    ecs.ScopePrefix = int(self.Data[3])
+
+    alen := net.IPv4len
+    if ecs.Family == 2 {
+        alen = net.IPv6len
+    } else if ecs.Family != 1 {
+        return nil, errors.New("unknown client subnet family")
+    }
+    if ecs.SourcePrefix > alen*8 || len(self.Data)-4 > alen {
+        return nil, errors.New("bad client subnet option")
+    }
+    ecs.Address = make(net.IP, alen)
+    copy(ecs.Address, self.Data[4:])
+    ecs.Address = ecs.Address.Mask(net.CIDRMask(ecs.SourcePrefix, alen*8))
+    return ecs, nil
+}
+
+// the address masked to prefix bits, as a string
+func (self *dnsEDNS0Subnet) masked(prefix int) string {
+    bits := len(self.Address) * 8
+    if prefix > bits {
+        prefix = bits
+    }
+    return self.Address.Mask(net.CIDRMask(prefix, bits)).String() + "/" + strconv.Itoa(prefix)
+}
+
 type dnsRR_OPT struct {
     dnsRR_unknown
-    rawRdata []byte
+    Options []dnsEDNS0Option
+}
+
+// the client subnet option, nil if there is none or it is malformed
+func (self *dnsRR_OPT) Subnet() *dnsEDNS0Subnet {
+    for i := range self.Options {
+        if self.Options[i].Code == dnsOptionSubnet {
+            ecs, _ := self.Options[i].subnet()
+            return ecs
+        }
+    }
+    return nil
+}
+
+func newOPT(udpSize int, do bool) *dnsRR_OPT {
+    opt := new(dnsRR_OPT)
+    opt.setHeader(&dnsRR_Header{Name: "", Rrtype: dnsTypeOPT})
+    opt.SetUDPSize(udpSize)
+    opt.SetDo(do)
+    return opt
+}
+
+func (self *dnsRR_OPT) UDPSize() int {
+    return int(self.Hdr.Class)
+}
+
+func (self *dnsRR_OPT) SetUDPSize(size int) {
+    self.Hdr.Class = uint16(size)
+}
+
+func (self *dnsRR_OPT) ExtendedRcode() int {
+    return int(self.Hdr.Ttl >> 24)
+}
+
+func (self *dnsRR_OPT) Version() int {
+    return int(self.Hdr.Ttl>>16) & 0xFF
+}
+
+func (self *dnsRR_OPT) Do() bool {
+    return self.Hdr.Ttl&_DO != 0
+}
+
+func (self *dnsRR_OPT) SetDo(do bool) {
+    if do {
+        self.Hdr.Ttl |= _DO
+    } else {
+        self.Hdr.Ttl &^= _DO
+    }
+}
+
+func (self *dnsRR_OPT) Rdata() interface{} {
+    return self.Options
 }
 
 func (self *dnsRR_OPT) String() string {
-    header := self.Hdr
-    return fmt.Sprintf("{name: %s, TTL: %d, class: %d, type: OPT, rdata: % x}",
-        header.Name, header.Ttl, header.Class, self.rawRdata)
+    s := fmt.Sprintf("{name: %s, type: OPT, udp: %d, ercode: %d, version: %d, do: %t, options: [",
+        self.Hdr.Name, self.UDPSize(), self.ExtendedRcode(), self.Version(), self.Do())
+    for i, o := range self.Options {
+        if i > 0 {
+            s += ", "
+        }
+        s += fmt.Sprintf("%d: % x", o.Code, o.Data)
+    }
+    return s + "]}"
 }
 
 func (self *dnsRR_OPT) unpackRdata(msg []byte, off int) {
-    self.rawRdata = msg[off:]
+    self.Options = make([]dnsEDNS0Option, 0, 1)
+    for off+4 <= len(msg) {
+        code := binary.BigEndian.Uint16(msg[off:])
+        length := int(binary.BigEndian.Uint16(msg[off+2:]))
+        off += 4
+        if off+length > len(msg) {
+            return
+        }
+        data := make([]byte, length)
+        copy(data, msg[off:off+length])
+        self.Options = append(self.Options, dnsEDNS0Option{Code: code, Data: data})
+        off += length
+    }
 }
 
 func (self *dnsRR_OPT) Pack(names map[string]int, off int) ([]byte, error) {
+    rdata := bytes.NewBuffer([]byte{})
+    for _, o := range self.Options {
+        binary.Write(rdata, binary.BigEndian, o.Code)
+        binary.Write(rdata, binary.BigEndian, uint16(len(o.Data)))
+        rdata.Write(o.Data)
+    }
+    self.Hdr.Rdlength = uint16(rdata.Len())
+
     buf, _ := self.Hdr.Pack(names, off)
-    buf.Write(self.rawRdata)
+    buf.Write(rdata.Bytes())
     return buf.Bytes(), nil
 }
 
+func (self *dnsRR_OPT) setRdata(data interface{}) error {
+    switch v := data.(type) {
+    case []dnsEDNS0Option:
+        self.Options = v
+    default:
+        return fmt.Errorf("Unsupported type")
+    }
+    return nil
+}
+
+// pack header and rdata, rdata is given the offset it is going
+// to be placed at so names in it can be compressed
+func (self *dnsRR_Header) packWithRdata(names map[string]int, off int, rdata func(off int) []byte) []byte {
+    buf := bytes.NewBuffer([]byte{})
+    namePack := packName(self.Name, names, off)
+    buf.Write(namePack)
+
+    rdataPack := rdata(off + len(namePack) + 10)
+    self.Rdlength = uint16(len(rdataPack))
+
+    var data = []interface{}{
+        self.Rrtype,
+        self.Class,
+        self.Ttl,
+        self.Rdlength,
+    }
+
+    for _, v := range data {
+        binary.Write(buf, binary.BigEndian, v)
+    }
+
+    buf.Write(rdataPack)
+    return buf.Bytes()
+}
+
+// presentation fields of rdata, either split already or a string
+func rdataFields(data interface{}, n int) ([]string, error) {
+    var fields []string
+    switch v := data.(type) {
+    case []string:
+        fields = v
+    case string:
+        fields = strings.Fields(v)
+    default:
+        return nil, fmt.Errorf("Unsupported type")
+    }
+    if len(fields) != n {
+        return nil, fmt.Errorf("%d rdata fields expected, got %d", n, len(fields))
+    }
+    return fields, nil
+}
+
+func parseUint16(s string) (uint16, error) {
+    v, err := strconv.ParseUint(s, 10, 16)
+    return uint16(v), err
+}
+
+//MX
+type dnsRR_MX struct {
+    dnsRR_unknown
+    Preference uint16
+    MX         string
+}
+
+func (self *dnsRR_MX) Rdata() interface{} {
+    return []string{strconv.Itoa(int(self.Preference)), self.MX}
+}
+
+func (self *dnsRR_MX) unpackRdata(msg []byte, off int) {
+    if off+2 > len(msg) {
+        return
+    }
+    self.Preference = binary.BigEndian.Uint16(msg[off:])
+    self.MX, _, _ = unpackName(msg, off+2)
+}
+
+func (self *dnsRR_MX) String() string {
+    header := self.Hdr
+    return fmt.Sprintf(
+        "{name: %s, TTL: %d, class: %d, type: MX, rdata: %d %s}",
+        header.Name, header.Ttl, header.Class, self.Preference, self.MX)
+}
+
+func (self *dnsRR_MX) Pack(names map[string]int, off int) ([]byte, error) {
+    return self.Hdr.packWithRdata(names, off, func(off int) []byte {
+        buf := bytes.NewBuffer([]byte{})
+        binary.Write(buf, binary.BigEndian, self.Preference)
+        buf.Write(packName(self.MX, names, off+2))
+        return buf.Bytes()
+    }), nil
+}
+
+func (self *dnsRR_MX) setRdata(data interface{}) error {
+    fields, err := rdataFields(data, 2)
+    if err != nil {
+        return err
+    }
+    if self.Preference, err = parseUint16(fields[0]); err != nil {
+        return err
+    }
+    self.MX = fields[1]
+    return nil
+}
+
+//TXT, one or more character-strings
+type dnsRR_TXT struct {
+    dnsRR_unknown
+    TXT []string
+}
+
+func (self *dnsRR_TXT) Rdata() interface{} {
+    return self.TXT
+}
+
+func (self *dnsRR_TXT) unpackRdata(msg []byte, off int) {
+    self.TXT = make([]string, 0, 1)
+    for off < len(msg) {
+        l := int(msg[off])
+        off++
+        if off+l > len(msg) {
+            return
+        }
+        self.TXT = append(self.TXT, string(msg[off:off+l]))
+        off += l
+    }
+}
+
+func (self *dnsRR_TXT) String() string {
+    header := self.Hdr
+    return fmt.Sprintf(
+        "{name: %s, TTL: %d, class: %d, type: TXT, rdata: %q}",
+        header.Name, header.Ttl, header.Class, self.TXT)
+}
+
+func (self *dnsRR_TXT) Pack(names map[string]int, off int) ([]byte, error) {
+    return self.Hdr.packWithRdata(names, off, func(off int) []byte {
+        buf := bytes.NewBuffer([]byte{})
+        for _, txt := range self.TXT {
+            buf.WriteByte(byte(len(txt)))
+            buf.WriteString(txt)
+        }
+        return buf.Bytes()
+    }), nil
+}
+
+func (self *dnsRR_TXT) setRdata(data interface{}) error {
+    var txts []string
+    switch v := data.(type) {
+    case []string:
+        txts = v
+    case string:
+        txts = []string{v}
+    default:
+        return fmt.Errorf("Unsupported type")
+    }
+
+    // a character-string holds at most 255 bytes
+    self.TXT = make([]string, 0, len(txts))
+    for _, txt := range txts {
+        for len(txt) > 255 {
+            self.TXT = append(self.TXT, txt[:255])
+            txt = txt[255:]
+        }
+        self.TXT = append(self.TXT, txt)
+    }
+    if len(self.TXT) == 0 {
+        self.TXT = append(self.TXT, "")
+    }
+    return nil
+}
+
+//SRV
+type dnsRR_SRV struct {
+    dnsRR_unknown
+    Priority uint16
+    Weight   uint16
+    Port     uint16
+    Target   string
+}
+
+func (self *dnsRR_SRV) Rdata() interface{} {
+    return []string{
+        strconv.Itoa(int(self.Priority)),
+        strconv.Itoa(int(self.Weight)),
+        strconv.Itoa(int(self.Port)),
+        self.Target,
+    }
+}
+
+func (self *dnsRR_SRV) unpackRdata(msg []byte, off int) {
+    if off+6 > len(msg) {
+        return
+    }
+    self.Priority = binary.BigEndian.Uint16(msg[off:])
+    self.Weight = binary.BigEndian.Uint16(msg[off+2:])
+    self.Port = binary.BigEndian.Uint16(msg[off+4:])
+    self.Target, _, _ = unpackName(msg, off+6)
+}
+
+func (self *dnsRR_SRV) String() string {
+    header := self.Hdr
+    return fmt.Sprintf(
+        "{name: %s, TTL: %d, class: %d, type: SRV, rdata: %d %d %d %s}",
+        header.Name, header.Ttl, header.Class,
+        self.Priority, self.Weight, self.Port, self.Target)
+}
+
+func (self *dnsRR_SRV) Pack(names map[string]int, off int) ([]byte, error) {
+    return self.Hdr.packWithRdata(names, off, func(off int) []byte {
+        buf := bytes.NewBuffer([]byte{})
+        binary.Write(buf, binary.BigEndian, self.Priority)
+        binary.Write(buf, binary.BigEndian, self.Weight)
+        binary.Write(buf, binary.BigEndian, self.Port)
+        // RFC 2782, the target must not be compressed
+        buf.Write(packName(self.Target, map[string]int{}, off+6))
+        return buf.Bytes()
+    }), nil
+}
+
+func (self *dnsRR_SRV) setRdata(data interface{}) error {
+    fields, err := rdataFields(data, 4)
+    if err != nil {
+        return err
+    }
+    vals := make([]uint16, 3)
+    for i := range vals {
+        if vals[i], err = parseUint16(fields[i]); err != nil {
+            return err
+        }
+    }
+    self.Priority, self.Weight, self.Port = vals[0], vals[1], vals[2]
+    self.Target = fields[3]
+    return nil
+}
+
+//PTR
+type dnsRR_PTR struct {
+    dnsRR_unknown
+    PTR string
+}
+
+func (self *dnsRR_PTR) Rdata() interface{} {
+    return self.PTR
+}
+
+func (self *dnsRR_PTR) unpackRdata(msg []byte, off int) {
+    self.PTR, _, _ = unpackName(msg, off)
+}
+
+func (self *dnsRR_PTR) String() string {
+    header := self.Hdr
+    return fmt.Sprintf(
+        "{name: %s, TTL: %d, class: %d, type: PTR, rdata: %s}",
+        header.Name, header.Ttl, header.Class, self.PTR)
+}
+
+func (self *dnsRR_PTR) Pack(names map[string]int, off int) ([]byte, error) {
+    return self.Hdr.packWithRdata(names, off, func(off int) []byte {
+        return packName(self.PTR, names, off)
+    }), nil
+}
+
+func (self *dnsRR_PTR) setRdata(data interface{}) error {
+    switch v := data.(type) {
+    case string:
+        self.PTR = v
+    case []byte:
+        self.PTR = string(v)
+    default:
+        return fmt.Errorf("Unsupported type")
+    }
+    return nil
+}
+
+//SOA
+type dnsRR_SOA struct {
+    dnsRR_unknown
+    Mname   string
+    Rname   string
+    Serial  uint32
+    Refresh uint32
+    Retry   uint32
+    Expire  uint32
+    Minimum uint32
+}
+
+func (self *dnsRR_SOA) Rdata() interface{} {
+    fields := []string{self.Mname, self.Rname}
+    for _, v := range []uint32{self.Serial, self.Refresh, self.Retry, self.Expire, self.Minimum} {
+        fields = append(fields, strconv.FormatUint(uint64(v), 10))
+    }
+    return fields
+}
+
+func (self *dnsRR_SOA) unpackRdata(msg []byte, off int) {
+    var err error
+    if self.Mname, off, err = unpackName(msg, off); err != nil {
+        return
+    }
+    if self.Rname, off, err = unpackName(msg, off); err != nil {
+        return
+    }
+    if off+20 > len(msg) {
+        return
+    }
+    buf := bytes.NewBuffer(msg[off : off+20])
+    for _, v := range []*uint32{&self.Serial, &self.Refresh, &self.Retry, &self.Expire, &self.Minimum} {
+        binary.Read(buf, binary.BigEndian, v)
+    }
+}
+
+func (self *dnsRR_SOA) String() string {
+    header := self.Hdr
+    return fmt.Sprintf(
+        "{name: %s, TTL: %d, class: %d, type: SOA, rdata: %s %s %d %d %d %d %d}",
+        header.Name, header.Ttl, header.Class, self.Mname, self.Rname,
+        self.Serial, self.Refresh, self.Retry, self.Expire, self.Minimum)
+}
+
+func (self *dnsRR_SOA) Pack(names map[string]int, off int) ([]byte, error) {
+    return self.Hdr.packWithRdata(names, off, func(off int) []byte {
+        buf := bytes.NewBuffer([]byte{})
+        buf.Write(packName(self.Mname, names, off))
+        buf.Write(packName(self.Rname, names, off+buf.Len()))
+        for _, v := range []uint32{self.Serial, self.Refresh, self.Retry, self.Expire, self.Minimum} {
+            binary.Write(buf, binary.BigEndian, v)
+        }
+        return buf.Bytes()
+    }), nil
+}
+
+func (self *dnsRR_SOA) setRdata(data interface{}) error {
+    fields, err := rdataFields(data, 7)
+    if err != nil {
+        return err
+    }
+    self.Mname, self.Rname = fields[0], fields[1]
+    // serial is a plain number, the timers may have units
+    serial, err := strconv.ParseUint(fields[2], 10, 32)
+    if err != nil {
+        return err
+    }
+    self.Serial = uint32(serial)
+    for i, v := range []*uint32{&self.Refresh, &self.Retry, &self.Expire, &self.Minimum} {
+        t, err := parseTTL(fields[3+i])
+        if err != nil {
+            return err
+        }
+        *v = uint32(t)
+    }
+    return nil
+}
+
 func unpackRR(msg []byte, off int) (rr dnsRR, next int, err error) {
     i := off
     header := new(dnsRR_Header)
@@ -415,6 +970,16 @@ func newRR(name string, rrtype int, ttl int, data interface{}) (dnsRR, error) {
 
     rr.setHeader(header)
 
+    // any type may be given in RFC 3597 form
+    if raw, ok, err := genericRdata(data); ok {
+        if err != nil {
+            return nil, err
+        }
+        header.Rdlength = uint16(len(raw))
+        rr.unpackRdata(raw, 0)
+        return rr, nil
+    }
+
     err := rr.setRdata(data)
 
     if err != nil {
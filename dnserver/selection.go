@@ -0,0 +1,131 @@
+package toydns
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// weight of a new sample in the smoothed RTT and error rate
+const statsAlpha = 0.3
+
+// the least RTT an upstream is credited with, so a lucky sample does
+// not take all the weight
+const minStatsRTT = time.Millisecond
+
+// smoothed RTT and error rate of an upstream
+type upstreamStats struct {
+	lock    sync.Mutex
+	rtt     time.Duration
+	errRate float64
+	samples int
+}
+
+// count the outcome of a query that took rtt
+func (self *upstreamEntry) observe(rtt time.Duration, err error) {
+	self.stats.lock.Lock()
+	defer self.stats.lock.Unlock()
+
+	failed := 0.0
+	if err != nil {
+		failed = 1.0
+	}
+	self.stats.errRate += statsAlpha * (failed - self.stats.errRate)
+	if err == nil {
+		if self.stats.rtt == 0 {
+			self.stats.rtt = rtt
+		} else {
+			self.stats.rtt += time.Duration(statsAlpha * float64(rtt-self.stats.rtt))
+		}
+	}
+	self.stats.samples++
+}
+
+// expected time to an answer, a failure costing the whole timeout;
+// 0 for an upstream never asked
+func (self *upstreamEntry) score(defaultTimeout time.Duration) time.Duration {
+	timeout := self.waitTime(defaultTimeout)
+	self.stats.lock.Lock()
+	defer self.stats.lock.Unlock()
+
+	if self.stats.samples == 0 {
+		return 0
+	}
+	rtt := self.stats.rtt
+	if rtt < minStatsRTT {
+		rtt = minStatsRTT
+	}
+	return rtt + time.Duration(self.stats.errRate*float64(timeout))
+}
+
+// upstreams asked in the order of a selection
+type upstreamGroup struct {
+	name      string
+	selection string
+	entries   []*upstreamEntry
+	next      uint32 // round robin position
+}
+
+func newUpstreamGroup(name string, selection string, entries []*upstreamEntry) *upstreamGroup {
+	switch selection {
+	case SELECT_FASTEST, SELECT_WEIGHTED_RANDOM, SELECT_ROUND_ROBIN:
+	default:
+		selection = SELECT_FIXED
+	}
+	return &upstreamGroup{name: name, selection: selection, entries: entries}
+}
+
+// a copy of the upstreams in the order to ask them, scored against
+// timeout unless they have their own
+func (self *upstreamGroup) ordered(timeout time.Duration) []*upstreamEntry {
+	n := len(self.entries)
+	entries := make([]*upstreamEntry, n)
+	copy(entries, self.entries)
+	if n < 2 {
+		return entries
+	}
+
+	switch self.selection {
+	case SELECT_ROUND_ROBIN:
+		start := int(atomic.AddUint32(&self.next, 1) % uint32(n))
+		for i := range entries {
+			entries[i] = self.entries[(start+i)%n]
+		}
+	case SELECT_FASTEST:
+		// ones never asked first, to get to know them
+		scores := make(map[*upstreamEntry]time.Duration, n)
+		for _, e := range entries {
+			scores[e] = e.score(timeout)
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return scores[entries[i]] < scores[entries[j]]
+		})
+	case SELECT_WEIGHTED_RANDOM:
+		// drawn one by one with a chance inverse to the score
+		weights := make([]float64, n)
+		total := 0.0
+		for i, e := range entries {
+			score := e.score(timeout)
+			if score < minStatsRTT {
+				score = minStatsRTT
+			}
+			weights[i] = 1 / score.Seconds()
+			total += weights[i]
+		}
+		for i := 0; i < n-1; i++ {
+			r := rand.Float64() * total
+			j := i
+			for ; j < n-1; j++ {
+				if r -= weights[j]; r < 0 {
+					break
+				}
+			}
+			entries[i], entries[j] = entries[j], entries[i]
+			weights[i], weights[j] = weights[j], weights[i]
+			total -= weights[i]
+		}
+	}
+	return entries
+}
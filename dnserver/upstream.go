@@ -3,12 +3,21 @@ package toydns
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 )
 
 type upstreamEntry struct {
 	protocol string
-	udpAddr  string
+	addr     string
 	cipher   *dnsCipher
+	timeout  time.Duration // 0 for upstream_timeout
+	retries  int
+	deadline time.Duration // 0 for none
+	health   upstreamHealth
+	stats    upstreamStats
+	poolLock sync.Mutex
+	pool     *upstreamPool // UDP sockets, dialed on first use
 }
 
 func newUpstreamEntry(entry interface{}) *upstreamEntry {
@@ -16,7 +25,7 @@ func newUpstreamEntry(entry interface{}) *upstreamEntry {
 	case string:
 		return &upstreamEntry{
 			protocol: PROTO_DNS,
-			udpAddr:  e,
+			addr:     e,
 			cipher:   nil,
 		}
 	case srvEntry:
@@ -27,8 +36,11 @@ func newUpstreamEntry(entry interface{}) *upstreamEntry {
 		}
 		return &upstreamEntry{
 			protocol: e.Protocol,
-			udpAddr:  addr,
+			addr:     addr,
 			cipher:   cipher,
+			timeout:  time.Duration(e.Timeout) * time.Millisecond,
+			retries:  e.Retries,
+			deadline: time.Duration(e.Deadline) * time.Millisecond,
 		}
 	default:
 		return nil
@@ -36,12 +48,39 @@ func newUpstreamEntry(entry interface{}) *upstreamEntry {
 
 }
 
-func dialUpstream(e *upstreamEntry) (dnsConn, error) {
+// how long to wait for the first reply
+func (self *upstreamEntry) waitTime(defaultTimeout time.Duration) time.Duration {
+	if self.timeout > 0 {
+		return self.timeout
+	}
+	return defaultTimeout
+}
+
+func (self *upstreamEntry) udpPool(bufSize int) *upstreamPool {
+	self.poolLock.Lock()
+	defer self.poolLock.Unlock()
+	if self.pool == nil {
+		self.pool = newUpstreamPool(self, bufSize)
+	}
+	return self.pool
+}
+
+func (self *upstreamEntry) closePool() {
+	self.poolLock.Lock()
+	defer self.poolLock.Unlock()
+	if self.pool != nil {
+		self.pool.Close()
+	}
+}
+
+func dialUpstream(e *upstreamEntry, bufSize int) (dnsConn, error) {
 	switch e.protocol {
 	case PROTO_DNS, PROTO_UDP:
-		return dialUDPDNS(e.udpAddr)
+		return dialUDPDNS(e.addr, bufSize)
+	case PROTO_TCP:
+		return dialTCPDNS(e.addr)
 	case PROTO_CRYPT:
-		return dialCryptDNS(e.udpAddr, e.cipher)
+		return dialCryptDNS(e.addr, e.cipher, bufSize)
 	default:
 		return nil, errors.New("Undifined Protocol")
 	}
@@ -0,0 +1,544 @@
+package toydns
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a UDP upstream answering with handler, or never if it returns nil
+func startTestUpstream(t *testing.T, handler func(q *dnsMsg) *dnsMsg) (addr string, stop func()) {
+	conn, err := listenUDPDNS("127.0.0.1:0", dnsDefaultEDNSSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			q, clientAddr, err := conn.ReadPacketFrom()
+			if err != nil {
+				return
+			}
+			if reply := handler(q); reply != nil {
+				conn.WritePacketTo(reply, clientAddr)
+			}
+		}
+	}()
+	return conn.udpConn.LocalAddr().String(), func() { conn.Close() }
+}
+
+// answers every question with an A record
+func answerA(ip string) func(q *dnsMsg) *dnsMsg {
+	return func(q *dnsMsg) *dnsMsg {
+		reply, _ := q.Reply()
+		rr, _ := newRR(q.question[0].Name, dnsTypeA, 300, ip)
+		reply.answer = []dnsRR{rr}
+		return reply
+	}
+}
+
+func silent(q *dnsMsg) *dnsMsg { return nil }
+
+func newTestServer(upstreams ...string) *DNSServer {
+	srv := &DNSServer{
+		cfg: &srvConfig{
+			Repeat:          1,
+			EDNSBufferSize:  dnsDefaultEDNSSize,
+			Strategy:        STRATEGY_SEQUENTIAL,
+			RaceCount:       1,
+			UpstreamTimeout: 500,
+			HealthProbe:     ".",
+		},
+		cache:    newDNSCache(0, 0),
+		inflight: newFlightGroup(),
+		done:     make(chan bool),
+	}
+	entries := []*upstreamEntry{}
+	for _, addr := range upstreams {
+		entries = append(entries, &upstreamEntry{protocol: PROTO_UDP, addr: addr})
+	}
+	srv.upstreams = newUpstreamGroup("", SELECT_FIXED, entries)
+	return srv
+}
+
+func testQuery(name string) *dnsMsg {
+	q := new(dnsMsg)
+	q.id = 4321
+	q.recursion_desired = true
+	q.question = []dnsQuestion{{name, dnsTypeA, dnsClassINET}}
+	return q
+}
+
+func Test_upstream_race(t *testing.T) {
+	dead, stopDead := startTestUpstream(t, silent)
+	defer stopDead()
+	alive, stopAlive := startTestUpstream(t, answerA("10.0.0.1"))
+	defer stopAlive()
+
+	srv := newTestServer(dead, alive)
+	start := time.Now()
+	if _, err := srv.forward(testQuery("seq.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("sequential answer in %v, before the dead upstream timed out", elapsed)
+	}
+
+	srv.cfg.Strategy = STRATEGY_RACE
+	srv.cfg.RaceCount = 2
+	start = time.Now()
+	pack, err := srv.forward(testQuery("race.example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("raced answer took %v", elapsed)
+	}
+	reply := new(dnsMsg)
+	reply.Unpack(pack, 0)
+	if len(reply.answer) != 1 {
+		t.Errorf("bad answer: %s", reply.String())
+	}
+
+	// all of them dead
+	srv = newTestServer(dead, dead, dead)
+	srv.cfg.Strategy = STRATEGY_RACE
+	srv.cfg.RaceCount = 2
+	if _, err := srv.forward(testQuery("dead.example.com.")); err == nil {
+		t.Error("answer from dead upstreams")
+	}
+}
+
+func Test_upstream_error_reply(t *testing.T) {
+	failing, stopFailing := startTestUpstream(t, func(q *dnsMsg) *dnsMsg {
+		reply, _ := q.Reply()
+		reply.rcode = dnsRcodeServerFailure
+		return reply
+	})
+	defer stopFailing()
+	slow, stopSlow := startTestUpstream(t, func(q *dnsMsg) *dnsMsg {
+		time.Sleep(100 * time.Millisecond)
+		return answerA("10.0.0.4")(q)
+	})
+	defer stopSlow()
+
+	// a SERVFAIL first loses to the answer coming later
+	for _, strategy := range []string{STRATEGY_SEQUENTIAL, STRATEGY_RACE} {
+		srv := newTestServer(failing, slow)
+		srv.cfg.Strategy = strategy
+		srv.cfg.RaceCount = 2
+		srv.cfg.ServFailCacheTTL = 30
+		pack, err := srv.forward(testQuery("fail.example.com."))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := new(dnsMsg)
+		reply.Unpack(pack, 0)
+		if reply.rcode != dnsRcodeSuccess || len(reply.answer) != 1 {
+			t.Errorf("%s reply %s", strategy, reply.String())
+		}
+		if cpack, found := srv.cache.Get(testQuestion("fail.example.com.", dnsTypeA)); !found || servFailed(cpack) {
+			t.Errorf("%s cached SERVFAIL %v", strategy, found)
+		}
+		if e := srv.upstreams.entries[0]; e.stats.errRate == 0 {
+			t.Errorf("%s SERVFAIL not counted as a failure", strategy)
+		}
+	}
+
+	// nothing better to give
+	srv := newTestServer(failing)
+	srv.cfg.Strategy = STRATEGY_RACE
+	if pack, err := srv.forward(testQuery("fail.example.com.")); err != nil || !servFailed(pack) {
+		t.Errorf("%v, SERVFAIL %v", err, servFailed(pack))
+	}
+}
+
+func Test_upstream_health(t *testing.T) {
+	var up int32
+	flaky, stopFlaky := startTestUpstream(t, func(q *dnsMsg) *dnsMsg {
+		if atomic.LoadInt32(&up) == 0 {
+			return nil
+		}
+		return answerA("10.0.0.2")(q)
+	})
+	defer stopFlaky()
+	alive, stopAlive := startTestUpstream(t, answerA("10.0.0.1"))
+	defer stopAlive()
+
+	srv := newTestServer(flaky, alive)
+	defer close(srv.done)
+	srv.cfg.HealthFailures = 2
+	srv.cfg.HealthBackoff = 1
+	flakyEntry := srv.upstreams.entries[0]
+
+	for i := 0; i < 2; i++ {
+		if _, err := srv.forward(testQuery("down.example.com.")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if flakyEntry.healthy() {
+		t.Fatal("upstream still up after 2 failures")
+	}
+
+	// skipped while down
+	start := time.Now()
+	if _, err := srv.forward(testQuery("skip.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Errorf("down upstream asked, answer took %v", elapsed)
+	}
+
+	// back after answering a probe
+	atomic.StoreInt32(&up, 1)
+	time.Sleep(1500 * time.Millisecond)
+	if !flakyEntry.healthy() {
+		t.Error("upstream still down after answering the probe")
+	}
+
+	// all down, ask them anyway
+	if got := healthyUpstreams([]*upstreamEntry{flakyEntry}); len(got) != 1 {
+		t.Errorf("healthy upstreams %v", got)
+	}
+}
+
+func Test_upstream_selection(t *testing.T) {
+	fast := &upstreamEntry{protocol: PROTO_UDP, addr: "fast"}
+	slow := &upstreamEntry{protocol: PROTO_UDP, addr: "slow"}
+	flaky := &upstreamEntry{protocol: PROTO_UDP, addr: "flaky"}
+	for i := 0; i < 10; i++ {
+		fast.observe(10*time.Millisecond, nil)
+		slow.observe(200*time.Millisecond, nil)
+		flaky.observe(5*time.Millisecond, nil)
+		flaky.observe(time.Second, errors.New("timeout"))
+	}
+	timeout := time.Second
+	entries := []*upstreamEntry{slow, flaky, fast}
+
+	g := newUpstreamGroup("", SELECT_FASTEST, entries)
+	if got := g.ordered(timeout); got[0] != fast || got[1] != slow || got[2] != flaky {
+		t.Errorf("fastest order %s %s %s", got[0].addr, got[1].addr, got[2].addr)
+	}
+	// never asked comes first
+	fresh := &upstreamEntry{protocol: PROTO_UDP, addr: "fresh"}
+	g = newUpstreamGroup("", SELECT_FASTEST, append(entries, fresh))
+	if got := g.ordered(timeout); got[0] != fresh {
+		t.Errorf("fastest starts with %s", got[0].addr)
+	}
+
+	g = newUpstreamGroup("", SELECT_ROUND_ROBIN, entries)
+	first := map[*upstreamEntry]int{}
+	for i := 0; i < 6; i++ {
+		got := g.ordered(timeout)
+		if len(got) != 3 {
+			t.Fatalf("%d upstreams", len(got))
+		}
+		first[got[0]]++
+	}
+	if first[fast] != 2 || first[slow] != 2 || first[flaky] != 2 {
+		t.Errorf("round robin firsts %v", first)
+	}
+
+	g = newUpstreamGroup("", SELECT_WEIGHTED_RANDOM, entries)
+	first = map[*upstreamEntry]int{}
+	for i := 0; i < 1000; i++ {
+		got := g.ordered(timeout)
+		seen := map[*upstreamEntry]bool{}
+		for _, e := range got {
+			seen[e] = true
+		}
+		if len(seen) != 3 {
+			t.Fatalf("weighted random order lost upstreams: %v", got)
+		}
+		first[got[0]]++
+	}
+	if first[fast] < first[slow] || first[fast] < first[flaky] || first[slow] == 0 {
+		t.Errorf("weighted random firsts fast %d slow %d flaky %d",
+			first[fast], first[slow], first[flaky])
+	}
+
+	g = newUpstreamGroup("", "bogus", entries)
+	if got := g.ordered(timeout); got[0] != slow || got[2] != fast {
+		t.Errorf("fixed order %s %s %s", got[0].addr, got[1].addr, got[2].addr)
+	}
+}
+
+func Test_upstream_group_route(t *testing.T) {
+	alive, stop := startTestUpstream(t, answerA("10.0.0.3"))
+	defer stop()
+
+	srv := newTestServer()
+	srv.groups = map[string]*upstreamGroup{
+		"far": newUpstreamGroup("far", SELECT_FASTEST,
+			[]*upstreamEntry{{protocol: PROTO_UDP, addr: alive}}),
+	}
+	upstreamTree = newSuffixTree("", nil)
+	defer func() { upstreamTree = nil }()
+	upstreamTree.sinsert([]string{"example", "com"}, "@far")
+
+	if _, err := srv.forward(testQuery("www.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	if e := srv.groups["far"].entries[0]; e.stats.samples != 1 || e.stats.rtt == 0 {
+		t.Errorf("stats not kept: %d samples, rtt %v", e.stats.samples, e.stats.rtt)
+	}
+}
+
+func Test_upstream_retries(t *testing.T) {
+	// drops every other query
+	var n int32
+	lossy, stop := startTestUpstream(t, func(q *dnsMsg) *dnsMsg {
+		if atomic.AddInt32(&n, 1)%2 == 1 {
+			return nil
+		}
+		return answerA("10.0.0.4")(q)
+	})
+	defer stop()
+
+	srv := newTestServer()
+	e := &upstreamEntry{protocol: PROTO_UDP, addr: lossy, timeout: 100 * time.Millisecond}
+	if _, err := srv.questionUpstream(e, *testQuery("once.example.com.")); err == nil {
+		t.Error("answer without retrying")
+	}
+	atomic.StoreInt32(&n, 0)
+	e.retries = 1
+	if _, err := srv.questionUpstream(e, *testQuery("twice.example.com.")); err != nil {
+		t.Errorf("retry failed: %s", err)
+	}
+
+	dead, stopDead := startTestUpstream(t, silent)
+	defer stopDead()
+	e = &upstreamEntry{protocol: PROTO_UDP, addr: dead,
+		timeout: 100 * time.Millisecond, retries: 5, deadline: 250 * time.Millisecond}
+	start := time.Now()
+	if _, err := srv.questionUpstream(e, *testQuery("late.example.com.")); err == nil {
+		t.Error("answer from a dead upstream")
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("gave up after %v, past the deadline", elapsed)
+	}
+}
+
+func Test_upstream_repeat(t *testing.T) {
+	// a reply under another ID and one to another question ahead of
+	// the real one, for each copy of the query
+	var lock sync.Mutex
+	queries := 0
+	conn, err := listenUDPDNS("127.0.0.1:0", dnsDefaultEDNSSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		for {
+			q, clientAddr, err := conn.ReadPacketFrom()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			queries++
+			lock.Unlock()
+
+			badID := answerA("6.6.6.6")(q)
+			badID.id++
+			badName := answerA("6.6.6.6")(q)
+			badName.question = []dnsQuestion{{"other.example.com.", dnsTypeA, dnsClassINET}}
+			for _, m := range []*dnsMsg{badID, badName, answerA("10.0.0.5")(q)} {
+				conn.WritePacketTo(m, clientAddr)
+			}
+		}
+	}()
+	addr := conn.udpConn.LocalAddr().String()
+
+	srv := newTestServer(addr)
+	e := srv.upstreams.entries[0]
+	uconn, err := dialUDPDNS(addr, dnsDefaultEDNSSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := testQuery("repeat.example.com.")
+	pooled, err := e.udpPool(dnsDefaultEDNSSize).exchange(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchanges := map[string]upstreamExchange{
+		"own conn": &connExchange{uconn, q, make(map[string]bool)},
+		"pooled":   pooled,
+	}
+	for desc, ex := range exchanges {
+		lock.Lock()
+		queries = 0
+		lock.Unlock()
+		pack, _ := q.Pack()
+		for i := 0; i < 3; i++ {
+			ex.send(pack)
+		}
+
+		_, reply, err := ex.recv(time.Now().Add(500 * time.Millisecond))
+		if err != nil {
+			t.Fatalf("%s: %s", desc, err)
+		}
+		if reply.id != q.id || len(reply.answer) != 1 ||
+			reply.answer[0].Rdata().(uint32) != 10<<24|5 {
+			t.Errorf("%s: bad reply %s", desc, reply.String())
+		}
+
+		// the copies of it and of the forged ones are dropped, as on a
+		// retry waiting for more
+		if _, reply, err = ex.recv(time.Now().Add(300 * time.Millisecond)); err == nil {
+			t.Errorf("%s: reply taken again %s", desc, reply.String())
+		}
+		lock.Lock()
+		if queries != 3 {
+			t.Errorf("%s: upstream asked %d times", desc, queries)
+		}
+		lock.Unlock()
+		ex.Close()
+	}
+}
+
+func Test_upstream_edns_options(t *testing.T) {
+	cookie := dnsEDNS0Option{Code: 10, Data: []byte("clientcookie")}
+	ecs := dnsEDNS0Option{Code: dnsOptionSubnet, Data: []byte{0, 1, 24, 0, 10, 1, 2}}
+	var lock sync.Mutex
+	var asked []dnsEDNS0Option
+	addr, stop := startTestUpstream(t, func(q *dnsMsg) *dnsMsg {
+		lock.Lock()
+		asked = q.opt().Options
+		lock.Unlock()
+		reply := answerA("10.0.0.10")(q)
+		ropt := newOPT(1232, true)
+		ropt.Options = []dnsEDNS0Option{
+			{Code: 10, Data: []byte("clientcookieservercookie")},
+			{Code: dnsOptionSubnet, Data: []byte{0, 1, 24, 24, 10, 1, 2}},
+		}
+		reply.setOPT(ropt)
+		return reply
+	})
+	defer stop()
+
+	srv := newTestServer(addr)
+	q := testQuery("edns.example.com.")
+	opt := newOPT(4096, true)
+	opt.Options = []dnsEDNS0Option{cookie, ecs}
+	q.setOPT(opt)
+	pack, err := srv.forward(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	if len(asked) != 1 || asked[0].Code != dnsOptionSubnet {
+		t.Errorf("options sent upstream %v", asked)
+	}
+	lock.Unlock()
+
+	reply := new(dnsMsg)
+	reply.Unpack(pack, 0)
+	ropt := reply.opt()
+	if ropt == nil || ropt.UDPSize() != dnsDefaultEDNSSize || len(ropt.Options) != 0 || !ropt.Do() {
+		t.Errorf("reply OPT %v", ropt)
+	}
+	cpack, found := srv.cache.Get(newCacheQuestion(q))
+	if !found {
+		t.Fatal("reply not cached")
+	}
+	reply.Unpack(cpack, 0)
+	if ropt := reply.opt(); ropt == nil || len(ropt.Options) != 0 {
+		t.Errorf("cached OPT %v", ropt)
+	}
+}
+
+func Test_upstream_tcp_fallback(t *testing.T) {
+	// a truncated reply over UDP, the whole one over TCP on the same port
+	addr, stop := startTestUpstream(t, func(q *dnsMsg) *dnsMsg {
+		reply, _ := q.Reply()
+		reply.truncated = true
+		return reply
+	})
+	defer stop()
+	ln, err := listenTCPDNS(addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	var lock sync.Mutex
+	tcpQueries := 0
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					q, clientAddr, err := conn.ReadPacketFrom()
+					if err != nil {
+						return
+					}
+					lock.Lock()
+					tcpQueries++
+					n := tcpQueries
+					lock.Unlock()
+					// the first one is lost, as by a slow link
+					if n > 1 {
+						conn.WritePacketTo(answerA("10.0.0.13")(q), clientAddr)
+					}
+				}
+			}()
+		}
+	}()
+
+	srv := newTestServer(addr)
+	e := srv.upstreams.entries[0]
+	e.timeout = 100 * time.Millisecond
+	e.retries = 1
+	pack, err := srv.questionUpstream(e, *testQuery("big.example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := new(dnsMsg)
+	reply.Unpack(pack, 0)
+	if reply.truncated || len(reply.answer) != 1 {
+		t.Errorf("reply %s", reply.String())
+	}
+	if _, found := srv.cache.Get(testQuestion("big.example.com.", dnsTypeA)); !found {
+		t.Error("whole reply not cached")
+	}
+	lock.Lock()
+	if tcpQueries != 2 {
+		t.Errorf("asked %d times over TCP", tcpQueries)
+	}
+	lock.Unlock()
+}
+
+func Test_upstream_tcp_fallback_failed(t *testing.T) {
+	// nothing listening on TCP
+	addr, stop := startTestUpstream(t, func(q *dnsMsg) *dnsMsg {
+		reply, _ := q.Reply()
+		reply.truncated = true
+		return reply
+	})
+	defer stop()
+
+	srv := newTestServer(addr)
+	defer close(srv.done)
+	srv.cfg.HealthFailures = 1
+	srv.cfg.HealthBackoff = 60
+	e := srv.upstreams.entries[0]
+	pack, err := srv.questionUpstream(e, *testQuery("big.example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := new(dnsMsg)
+	reply.Unpack(pack, 0)
+	if !reply.truncated {
+		t.Errorf("reply %s", reply.String())
+	}
+	if e.healthy() || e.stats.samples != 2 || e.stats.errRate == 0 {
+		t.Errorf("failed TCP fallback not counted: healthy %t, %d samples, error rate %f",
+			e.healthy(), e.stats.samples, e.stats.errRate)
+	}
+}
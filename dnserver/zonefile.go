@@ -0,0 +1,481 @@
+package toydns
+
+// RFC 1035 master file format, as written by BIND and friends
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errUnsupportedRR = errors.New("unsupported record type")
+
+type zoneToken struct {
+	raw    string // as written in the file
+	text   string // quotes removed and escapes decoded
+	quoted bool
+}
+
+// a logical line, parentheses may span it over several physical lines
+type zoneLine struct {
+	tokens     []zoneToken
+	blankOwner bool // the line starts with blank, owner is the previous one
+	line       int
+}
+
+// split a master file into logical lines, calling emit on each of them
+func lexZone(rd io.Reader, emit func(e *zoneLine) error) error {
+	br := bufio.NewReader(rd)
+	lineno, parens := 1, 0
+	entry := &zoneLine{line: lineno}
+	startOfLine := true
+
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch c {
+		case '\n':
+			lineno++
+			if parens == 0 {
+				if len(entry.tokens) > 0 {
+					if err := emit(entry); err != nil {
+						return err
+					}
+				}
+				entry = &zoneLine{line: lineno}
+				startOfLine = true
+				continue
+			}
+		case ' ', '\t', '\r':
+			if startOfLine {
+				entry.blankOwner = true
+			}
+		case ';':
+			if _, err := br.ReadString('\n'); err == nil {
+				br.UnreadByte()
+			}
+		case '(':
+			parens++
+		case ')':
+			if parens == 0 {
+				return fmt.Errorf("line %d: unbalanced parenthesis", lineno)
+			}
+			parens--
+		case '"':
+			tok, lines, err := lexQuoted(br)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", lineno, err.Error())
+			}
+			lineno += lines
+			entry.tokens = append(entry.tokens, tok)
+		default:
+			br.UnreadByte()
+			entry.tokens = append(entry.tokens, lexWord(br))
+		}
+		startOfLine = false
+	}
+
+	if parens != 0 {
+		return fmt.Errorf("line %d: unbalanced parenthesis", lineno)
+	}
+	if len(entry.tokens) > 0 {
+		return emit(entry)
+	}
+	return nil
+}
+
+// read a bare word up to a blank or special character
+func lexWord(br *bufio.Reader) zoneToken {
+	raw := make([]byte, 0, 16)
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			break
+		}
+		if c == '\\' {
+			raw = append(raw, c)
+			if c, err = br.ReadByte(); err != nil {
+				break
+			}
+			raw = append(raw, c)
+			continue
+		}
+		if strings.IndexByte(" \t\r\n;()\"", c) >= 0 {
+			br.UnreadByte()
+			break
+		}
+		raw = append(raw, c)
+	}
+	return zoneToken{raw: string(raw), text: unescapeZone(string(raw))}
+}
+
+// read a quoted string, the opening quote is already consumed
+func lexQuoted(br *bufio.Reader) (tok zoneToken, lines int, err error) {
+	raw := make([]byte, 0, 16)
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return tok, lines, errors.New("unterminated quoted string")
+		}
+		if c == '"' {
+			break
+		}
+		if c == '\n' {
+			lines++
+		}
+		raw = append(raw, c)
+		if c == '\\' {
+			if c, err = br.ReadByte(); err != nil {
+				return tok, lines, errors.New("unterminated quoted string")
+			}
+			raw = append(raw, c)
+		}
+	}
+	return zoneToken{raw: string(raw), text: unescapeZone(string(raw)), quoted: true}, lines, nil
+}
+
+// decode \X and \DDD escapes
+func unescapeZone(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			buf = append(buf, s[i])
+			continue
+		}
+		i++
+		if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			if d, err := strconv.Atoi(s[i : i+3]); err == nil && d < 256 {
+				buf = append(buf, byte(d))
+				i += 2
+				continue
+			}
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parse a TTL, either in seconds or with BIND style units like 1h30m
+func parseTTL(s string) (int, error) {
+	if len(s) == 0 || !isDigit(s[0]) {
+		return 0, fmt.Errorf("bad TTL: %s", s)
+	}
+
+	ttl, num := 0, 0
+	units := map[byte]int{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isDigit(c) {
+			num = num*10 + int(c-'0')
+			continue
+		}
+		unit, ok := units[c|0x20]
+		if !ok || i == 0 || !isDigit(s[i-1]) {
+			return 0, fmt.Errorf("bad TTL: %s", s)
+		}
+		ttl += num * unit
+		num = 0
+	}
+	return ttl + num, nil
+}
+
+func parseClass(s string) (int, bool) {
+	switch strings.ToUpper(s) {
+	case "IN":
+		return dnsClassINET, true
+	case "CS":
+		return dnsClassCSNET, true
+	case "CH":
+		return dnsClassCHAOS, true
+	case "HS":
+		return dnsClassHESIOD, true
+	}
+	return 0, false
+}
+
+type zoneParser struct {
+	zone      *domain
+	file      string
+	origin    string
+	ttl       int // from $TTL, -1 if not set
+	lastTTL   int // last explicit TTL, -1 if none yet
+	lastOwner string
+}
+
+// read a master zone file into db, origin is the zone apex and the
+// initial origin for relative names
+func readZoneFile(db *domainDB, path string, origin string) error {
+	if origin != "" && !strings.HasSuffix(origin, ".") {
+		origin += "."
+	}
+
+	p := &zoneParser{file: path, origin: origin, ttl: -1, lastTTL: -1}
+	if origin != "" {
+		zone, err := db.addDomain(origin)
+		if err != nil {
+			return err
+		}
+		p.zone = zone
+	}
+
+	if err := p.parseFile(db); err != nil {
+		return err
+	}
+	if p.zone == nil {
+		return fmt.Errorf("%s: no origin for zone", path)
+	}
+	return nil
+}
+
+func (p *zoneParser) parseFile(db *domainDB) error {
+	file, err := os.Open(p.file)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return lexZone(file, func(e *zoneLine) error {
+		if err := p.entry(db, e); err != nil {
+			return fmt.Errorf("%s:%d: %s", p.file, e.line, err.Error())
+		}
+		return nil
+	})
+}
+
+func (p *zoneParser) entry(db *domainDB, e *zoneLine) error {
+	tokens := e.tokens
+
+	if !e.blankOwner && strings.HasPrefix(tokens[0].raw, "$") {
+		return p.directive(db, tokens)
+	}
+
+	owner := p.lastOwner
+	if !e.blankOwner {
+		name, err := p.absName(tokens[0].text)
+		if err != nil {
+			return err
+		}
+		owner = name
+		tokens = tokens[1:]
+	}
+	if owner == "" {
+		return errors.New("no owner name")
+	}
+	p.lastOwner = owner
+
+	// [TTL] [class] type, TTL and class in either order
+	ttl, class, rrtype := -1, dnsClassINET, -1
+	for len(tokens) > 0 && rrtype < 0 {
+		t := tokens[0].text
+		tokens = tokens[1:]
+		if v, err := parseTTL(t); err == nil && ttl < 0 {
+			ttl = v
+			p.lastTTL = v
+		} else if c, ok := parseClass(t); ok {
+			class = c
+		} else if v, ok := dnsTypeFromString(t); ok {
+			rrtype = int(v)
+		} else {
+			return fmt.Errorf("unknown record type: %s", t)
+		}
+	}
+	if rrtype < 0 {
+		return errors.New("missing record type")
+	}
+
+	if ttl < 0 {
+		if p.ttl >= 0 {
+			ttl = p.ttl
+		} else if p.lastTTL >= 0 {
+			ttl = p.lastTTL
+		} else {
+			return errors.New("no TTL and no $TTL")
+		}
+	}
+
+	if class != dnsClassINET {
+		logger.Warning("%s:%d: skipping non IN record", p.file, e.line)
+		return nil
+	}
+
+	if p.zone == nil {
+		zone, err := db.addDomain(owner)
+		if err != nil {
+			return err
+		}
+		p.zone = zone
+	}
+
+	data, err := p.rdata(rrtype, tokens)
+	if err == errUnsupportedRR {
+		logger.Warning("%s:%d: skipping unsupported %s record", p.file, e.line, dnsTypeString(uint16(rrtype)))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	record, name, err := p.relative(owner)
+	if err != nil {
+		return err
+	}
+
+	rr, err := newRR(name, rrtype, ttl, data)
+	if err != nil {
+		return err
+	}
+	p.zone.addRecord(record, rr)
+	return nil
+}
+
+func (p *zoneParser) directive(db *domainDB, tokens []zoneToken) error {
+	if len(tokens) < 2 {
+		return fmt.Errorf("%s needs an argument", tokens[0].raw)
+	}
+
+	switch strings.ToUpper(tokens[0].raw) {
+	case "$ORIGIN":
+		origin, err := p.absName(tokens[1].text)
+		if err != nil {
+			return err
+		}
+		p.origin = origin
+
+	case "$TTL":
+		ttl, err := parseTTL(tokens[1].text)
+		if err != nil {
+			return err
+		}
+		p.ttl = ttl
+
+	case "$INCLUDE":
+		// the included file gets its own origin, ours is restored after it
+		sub := *p
+		sub.file = tokens[1].text
+		if !filepath.IsAbs(sub.file) {
+			sub.file = filepath.Join(filepath.Dir(p.file), sub.file)
+		}
+		if len(tokens) > 2 {
+			origin, err := p.absName(tokens[2].text)
+			if err != nil {
+				return err
+			}
+			sub.origin = origin
+		}
+		if err := sub.parseFile(db); err != nil {
+			return err
+		}
+		p.zone = sub.zone
+
+	default:
+		return fmt.Errorf("unknown directive: %s", tokens[0].raw)
+	}
+	return nil
+}
+
+// make name absolute
+func (p *zoneParser) absName(name string) (string, error) {
+	switch {
+	case name == "@":
+		if p.origin == "" {
+			return "", errors.New("@ used without origin")
+		}
+		return p.origin, nil
+	case strings.HasSuffix(name, "."):
+		return name, nil
+	case p.origin == "":
+		return "", fmt.Errorf("relative name %s without origin", name)
+	case p.origin == ".":
+		return name + ".", nil
+	}
+	return name + "." + p.origin, nil
+}
+
+// the record key and stored name of owner in the zone,
+// following what readRecords does
+func (p *zoneParser) relative(owner string) (record string, name string, err error) {
+	zname := p.zone.name
+	lowner, lzone := strings.ToLower(owner), strings.ToLower(zname)
+	if lowner == lzone {
+		return "@", zname, nil
+	}
+	if !strings.HasSuffix(lowner, "."+lzone) {
+		return "", "", fmt.Errorf("%s is out of zone %s", owner, zname)
+	}
+
+	record = owner[:len(owner)-len(zname)-1]
+	if record == "*" {
+		return record, "", nil
+	}
+	return record, owner, nil
+}
+
+// convert rdata tokens to what newRR takes for rrtype
+func (p *zoneParser) rdata(rrtype int, tokens []zoneToken) (interface{}, error) {
+	// RFC 3597 form is accepted for any type, newRR decodes it
+	if len(tokens) > 0 && tokens[0].raw == `\#` && !tokens[0].quoted {
+		if rrtype == dnsTypeOPT {
+			return nil, errUnsupportedRR
+		}
+		fields := make([]string, len(tokens))
+		for i, t := range tokens {
+			fields[i] = t.raw
+		}
+		return fields, nil
+	}
+
+	switch rrtype {
+	case dnsTypeA, dnsTypeAAAA:
+		if len(tokens) != 1 {
+			return nil, errors.New("address expected")
+		}
+		ip := net.ParseIP(tokens[0].text)
+		if ip == nil || (rrtype == dnsTypeA) != (ip.To4() != nil) {
+			return nil, fmt.Errorf("bad address: %s", tokens[0].text)
+		}
+		return ip, nil
+
+	case dnsTypeCNAME, dnsTypeNS, dnsTypePTR:
+		if len(tokens) != 1 {
+			return nil, errors.New("domain name expected")
+		}
+		return p.absName(tokens[0].text)
+
+	case dnsTypeMX, dnsTypeSRV, dnsTypeSOA, dnsTypeTXT:
+		fields := make([]string, len(tokens))
+		for i, t := range tokens {
+			fields[i] = t.text
+		}
+		for _, i := range rdataNameFields[rrtype] {
+			if i >= len(fields) {
+				break
+			}
+			name, err := p.absName(fields[i])
+			if err != nil {
+				return nil, err
+			}
+			fields[i] = name
+		}
+		return fields, nil
+	}
+
+	return nil, errUnsupportedRR
+}
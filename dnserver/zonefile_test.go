@@ -0,0 +1,126 @@
+package toydns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_zone_file(t *testing.T) {
+	dir, err := ioutil.TempDir("", "toydns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zone := `$ORIGIN thunics.org.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2014010101 ; serial
+		3600 600 86400 300 )
+	IN	NS	ns1
+	IN	A	10.137.1.1
+ns1	600	IN	A	10.137.1.2
+www		A	10.137.1.3
+		A	10.137.1.4
+db3	IN 1d	CNAME	srv3
+*	A	10.137.9.9
+$INCLUDE sub.zone lab.thunics.org.
+txt	TXT	"hello; world" "with \"escapes\" \065"
+srv3.thunics.org.	A	10.137.2.3
+`
+	sub := `gpu	A	10.138.0.1
+`
+	ioutil.WriteFile(filepath.Join(dir, "thunics.zone"), []byte(zone), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub.zone"), []byte(sub), 0644)
+
+	db := newDomainDB()
+	if err := readZoneFile(db, filepath.Join(dir, "thunics.zone"), "thunics.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	records := db.domains["thunics.org."].records
+	for r, set := range records {
+		for _, rr := range set.rrs {
+			fmt.Printf("%s: %s\n", r, rr.String())
+		}
+	}
+
+	expect := map[string]int{
+		rkeyGen("@", dnsTypeNS):      1,
+		rkeyGen("@", dnsTypeA):       1,
+		rkeyGen("www", dnsTypeA):     2,
+		rkeyGen("gpu.lab", dnsTypeA): 1,
+		rkeyGen("srv3", dnsTypeA):    1,
+		rkeyGen("*", dnsTypeA):       1,
+		rkeyGen("db3", dnsTypeCNAME): 1,
+	}
+	for rkey, n := range expect {
+		if set, found := records[rkey]; !found || len(set.rrs) != n {
+			t.Errorf("%s: expected %d records", rkey, n)
+		}
+	}
+
+	if ttl := records[rkeyGen("www", dnsTypeA)].rrs[1].Header().Ttl; ttl != 3600 {
+		t.Errorf("www TTL %d, expected 3600", ttl)
+	}
+	if ttl := records[rkeyGen("db3", dnsTypeCNAME)].rrs[0].Header().Ttl; ttl != 86400 {
+		t.Errorf("db3 TTL %d, expected 86400", ttl)
+	}
+	if cname := records[rkeyGen("db3", dnsTypeCNAME)].rrs[0].Rdata(); cname != "srv3.thunics.org." {
+		t.Errorf("db3 CNAME %s", cname)
+	}
+
+	soa := records[rkeyGen("@", dnsTypeSOA)].rrs[0].(*dnsRR_SOA)
+	if soa.Mname != "ns1.thunics.org." || soa.Serial != 2014010101 || soa.Minimum != 300 {
+		t.Error("bad SOA:", soa.String())
+	}
+	txt := records[rkeyGen("txt", dnsTypeTXT)].rrs[0].(*dnsRR_TXT)
+	if len(txt.TXT) != 2 || txt.TXT[0] != "hello; world" || txt.TXT[1] != `with "escapes" A` {
+		t.Error("bad TXT:", txt.String())
+	}
+
+	queries := []struct {
+		qname  string
+		qtype  int
+		result int
+		nans   int
+	}{
+		{"db3.thunics.org.", dnsTypeA, querySuccess, 2},
+		{"WWW.Thunics.ORG.", dnsTypeA, querySuccess, 2},
+		{"foo.thunics.org.", dnsTypeA, querySuccess, 1},
+		{"foo.thunics.org.", dnsTypeMX, queryNoData, 0},
+		{"www.thunics.org.", dnsTypeMX, queryNoData, 0},
+		{"lab.thunics.org.", dnsTypeA, queryNoData, 0},
+		{"nope.lab.thunics.org.", dnsTypeA, queryNXDomain, 0},
+		{"thunics.org.", dnsTypeSOA, querySuccess, 1},
+		{"foothunics.org.", dnsTypeA, queryNotOwned, 0},
+	}
+	for _, q := range queries {
+		ans := make([]dnsRR, 0, 2)
+		result, _ := queryDB(q.qname, q.qtype, db, &ans)
+		if result != q.result || len(ans) != q.nans {
+			t.Errorf("%s[%s]: result %d with %d answers, expected %d with %d",
+				q.qname, dnsTypeString(uint16(q.qtype)), result, len(ans), q.result, q.nans)
+		}
+	}
+	if soa := db.domains["thunics.org."].negativeSOA(); soa.Header().Ttl != 300 {
+		t.Error("negative SOA TTL is not the minimum:", soa.String())
+	}
+}
+
+func Test_zone_lexer(t *testing.T) {
+	for s, v := range map[string]int{"300": 300, "1h": 3600, "1h30m": 5400, "1W": 604800} {
+		if ttl, err := parseTTL(s); err != nil || ttl != v {
+			t.Errorf("parseTTL(%s) = %d, %v", s, ttl, err)
+		}
+	}
+	if _, err := parseTTL("IN"); err == nil {
+		t.Error("IN parsed as TTL")
+	}
+	if s := unescapeZone(`a\.b\065\\`); s != `a.bA\` {
+		t.Errorf("bad unescape: %s", s)
+	}
+}
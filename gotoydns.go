@@ -2,8 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	stdlog "log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/bigeagle/go-logging"
 	"github.com/bigeagle/gotoydns/dnserver"
@@ -37,10 +40,20 @@ func checkError(err error) {
 func main() {
 	flag.StringVar(&configFile, "c", "/etc/godnsd.conf", "Config File")
 	flag.BoolVar(&debugMode, "debug", false, "Debug")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [cache list|flush|pin ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	initLogging()
 
+	// talk to a running server
+	if flag.NArg() > 0 {
+		checkError(toydns.Control(configFile, flag.Args(), os.Stdout, logger))
+		return
+	}
+
 	//logger.Debug(port)
 	logger.Debug(configFile)
 	dnserver, err := toydns.NewServer(configFile, logger)
@@ -49,5 +62,14 @@ func main() {
 		logger.Fatal("Failed to init DNS server: ", err)
 	}
 
-	dnserver.ServeForever()
+	// save state before going down
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logger.Info("Got %v, shutting down", sig)
+		dnserver.Shutdown()
+	}()
+
+	checkError(dnserver.ServeForever())
 }